@@ -0,0 +1,19 @@
+package config
+
+import "testing"
+
+// env を指定し忘れても、開発用の秘密鍵のままでは起動しない
+func TestDefaultRejectsDevSecret(t *testing.T) {
+	cfg := Default()
+	if cfg.IsDev() {
+		t.Fatal("既定の env が dev になっている")
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Error("デフォルトの jwt.secret のまま検証を通った")
+	}
+
+	cfg.Env = EnvDev
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("dev を明示したのに失敗: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+// メッセージ添付ファイル
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const maxAttachmentsPerMessage = 10
+
+var errInvalidAttachment = errors.New("添付が不正です")
+
+type Attachment struct {
+	URL              string `json:"url"`
+	MimeType         string `json:"mime_type,omitempty"`
+	Size             int64  `json:"size,omitempty"`
+	Width            int    `json:"width,omitempty"`
+	Height           int    `json:"height,omitempty"`
+	OriginalFilename string `json:"original_filename,omitempty"`
+}
+
+// メッセージ1件分の添付をJSON配列で返すSQL断片（m は messages の別名）
+const attachmentsJSONColumn = `COALESCE((
+	SELECT json_agg(json_build_object(
+		'url', a.file_url,
+		'mime_type', a.mime_type,
+		'size', a.size_bytes,
+		'width', a.width,
+		'height', a.height,
+		'original_filename', a.original_filename
+	) ORDER BY a.position, a.id)
+	FROM message_attachments a
+	WHERE a.message_id = m.id
+), '[]'::json)`
+
+// 受け取った添付を検証する。legacyImage は image フィールドしか送らない古いクライアント向け
+// 送信者本人が /upload したファイルだけを受け付け、メタデータはアップロード時に記録したものに置き換える
+func normalizeAttachments(ctx context.Context, db *pgxpool.Pool, senderID int, atts []Attachment, legacyImage string) ([]Attachment, error) {
+	if legacyImage != "" && len(atts) == 0 {
+		atts = []Attachment{{URL: legacyImage}}
+	}
+	if len(atts) > maxAttachmentsPerMessage {
+		return nil, fmt.Errorf("%w: 添付は%d件までです", errInvalidAttachment, maxAttachmentsPerMessage)
+	}
+	if len(atts) == 0 {
+		return atts, nil
+	}
+
+	urls := make([]string, len(atts))
+	for i, a := range atts {
+		if !isUploadURL(a.URL) {
+			return nil, fmt.Errorf("%w: %s", errInvalidAttachment, a.URL)
+		}
+		urls[i] = a.URL
+	}
+
+	rows, err := db.Query(ctx,
+		`SELECT file_url, mime_type, size_bytes, COALESCE(width, 0), COALESCE(height, 0), original_filename
+		 FROM uploads WHERE user_id = $1 AND file_url = ANY($2)`,
+		senderID, urls)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	uploaded := make(map[string]Attachment, len(urls))
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.URL, &a.MimeType, &a.Size, &a.Width, &a.Height, &a.OriginalFilename); err != nil {
+			return nil, err
+		}
+		uploaded[a.URL] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]Attachment, len(atts))
+	for i, a := range atts {
+		u, ok := uploaded[a.URL]
+		if !ok {
+			return nil, fmt.Errorf("%w: アップロードしていないファイルです: %s", errInvalidAttachment, a.URL)
+		}
+		out[i] = u
+	}
+	return out, nil
+}
+
+// アップロード済みのファイル（/upload が返した URL）か
+func isUploadURL(url string) bool {
+	return strings.HasPrefix(url, "/uploads/") && !strings.Contains(url, "..")
+}
+
+func insertAttachments(ctx context.Context, tx pgx.Tx, messageID int, atts []Attachment) error {
+	for i, a := range atts {
+		_, err := tx.Exec(ctx,
+			`INSERT INTO message_attachments
+			   (message_id, file_url, mime_type, size_bytes, width, height, original_filename, position, created_at)
+			 VALUES ($1, $2, NULLIF($3, ''), NULLIF($4::bigint, 0), NULLIF($5, 0), NULLIF($6, 0), NULLIF($7, ''), $8, now())`,
+			messageID, a.URL, a.MimeType, a.Size, a.Width, a.Height, a.OriginalFilename, i,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 古いクライアント向けに先頭の添付URLを image として返す
+func firstAttachmentURL(atts []Attachment) string {
+	if len(atts) == 0 {
+		return ""
+	}
+	return atts[0].URL
+}
+
+// 添付がなくスタンプだけのメッセージは、スタンプのURLを image として返す
+func legacyImageURL(atts []Attachment, stampURL string) string {
+	if url := firstAttachmentURL(atts); url != "" {
+		return url
+	}
+	return stampURL
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// 添付は送信者本人のアップロードに限り、メタデータはアップロード時の記録を使う
+func TestNormalizeAttachmentsUsesOwnUploads(t *testing.T) {
+	e := newTestEnv(t)
+	alice, _ := e.user(t, "alice")
+	mallory, _ := e.user(t, "mallory")
+	ctx := context.Background()
+	if _, err := e.db.Exec(ctx,
+		`INSERT INTO uploads (file_url, user_id, mime_type, size_bytes, width, height, original_filename)
+		 VALUES ('/uploads/a.png', $1, 'image/png', 100, 20, 10, 'a.png')`, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	claimed := []Attachment{{URL: "/uploads/a.png", MimeType: "text/html", Size: 1, OriginalFilename: "x.html"}}
+	got, err := normalizeAttachments(ctx, e.db, alice, claimed, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Attachment{URL: "/uploads/a.png", MimeType: "image/png", Size: 100, Width: 20, Height: 10, OriginalFilename: "a.png"}
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("attachments = %+v, want [%+v]", got, want)
+	}
+
+	if _, err := normalizeAttachments(ctx, e.db, mallory, claimed, ""); !errors.Is(err, errInvalidAttachment) {
+		t.Errorf("他人のアップロード: err = %v, want errInvalidAttachment", err)
+	}
+}
@@ -0,0 +1,111 @@
+// ルームメンバーシップ認可
+// room_members の参照結果を短時間キャッシュし、REST・WebSocket の両方から使う
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const membershipCacheTTL = 30 * time.Second
+
+type memberKey struct {
+	roomID int
+	userID int
+}
+
+type memberEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+type RoomAuthorizer struct {
+	db        *pgxpool.Pool
+	ttl       time.Duration
+	mu        sync.Mutex
+	cache     map[memberKey]memberEntry
+	nextSweep time.Time // 期限切れのエントリをまとめて消す時刻
+}
+
+func NewRoomAuthorizer(db *pgxpool.Pool) *RoomAuthorizer {
+	return &RoomAuthorizer{
+		db:    db,
+		ttl:   membershipCacheTTL,
+		cache: make(map[memberKey]memberEntry),
+	}
+}
+
+// userID が roomID のメンバーかどうか
+func (a *RoomAuthorizer) IsMember(ctx context.Context, roomID, userID int) (bool, error) {
+	key := memberKey{roomID: roomID, userID: userID}
+
+	a.mu.Lock()
+	entry, hit := a.cache[key]
+	a.mu.Unlock()
+	if hit && time.Now().Before(entry.expires) {
+		return entry.ok, nil
+	}
+
+	var ok bool
+	err := a.db.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM room_members WHERE room_id = $1 AND user_id = $2)`,
+		roomID, userID,
+	).Scan(&ok)
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	a.cache[key] = memberEntry{ok: ok, expires: now.Add(a.ttl)}
+	a.sweep(now)
+	a.mu.Unlock()
+	return ok, nil
+}
+
+// 一度しか見ない (room, user) が溜まらないよう、ttl ごとに期限切れを消す。a.mu を持って呼ぶ
+func (a *RoomAuthorizer) sweep(now time.Time) {
+	if now.Before(a.nextSweep) {
+		return
+	}
+	for k, e := range a.cache {
+		if !now.Before(e.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.nextSweep = now.Add(a.ttl)
+}
+
+// メンバーでなければ403を返して false を返す
+func (a *RoomAuthorizer) Require(w http.ResponseWriter, r *http.Request, roomID, userID int) bool {
+	ok, err := a.IsMember(r.Context(), roomID, userID)
+	if err != nil {
+		log.Println("メンバー確認失敗:", err)
+		http.Error(w, "メンバー確認に失敗しました", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "このルームへのアクセス権がありません", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// メンバーの追加・削除時にキャッシュを捨てる（ハブ経由で他インスタンスの変更も届く）
+func (a *RoomAuthorizer) Invalidate(userID, roomID int) {
+	a.mu.Lock()
+	delete(a.cache, memberKey{roomID: roomID, userID: userID})
+	a.mu.Unlock()
+}
+
+// 認証済みユーザー名からユーザーIDを引く
+func userIDByName(ctx context.Context, db *pgxpool.Pool, username string) (int, error) {
+	var id int
+	err := db.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", username).Scan(&id)
+	return id, err
+}
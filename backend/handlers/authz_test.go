@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRoomAuthorizerSweep(t *testing.T) {
+	a := NewRoomAuthorizer(nil)
+	now := time.Now()
+	a.cache[memberKey{roomID: 1, userID: 1}] = memberEntry{ok: true, expires: now.Add(-time.Second)}
+	a.cache[memberKey{roomID: 2, userID: 1}] = memberEntry{ok: true, expires: now.Add(time.Second)}
+
+	a.sweep(now)
+	if _, ok := a.cache[memberKey{roomID: 1, userID: 1}]; ok {
+		t.Error("期限切れのエントリが残っている")
+	}
+	if _, ok := a.cache[memberKey{roomID: 2, userID: 1}]; !ok {
+		t.Error("有効なエントリが消えた")
+	}
+
+	// 次の掃除までは期限切れでも残す
+	a.cache[memberKey{roomID: 3, userID: 1}] = memberEntry{expires: now.Add(-time.Second)}
+	a.sweep(now.Add(a.ttl / 2))
+	if _, ok := a.cache[memberKey{roomID: 3, userID: 1}]; !ok {
+		t.Error("掃除の間隔より前に消えた")
+	}
+	a.sweep(now.Add(a.ttl))
+	if len(a.cache) != 0 {
+		t.Errorf("cache = %v, want 空", a.cache)
+	}
+}
+
+func TestRoomScopedHandlersRequireMembership(t *testing.T) {
+	e := newTestEnv(t)
+	alice, aliceToken := e.user(t, "alice")
+	_, malloryToken := e.user(t, "mallory")
+	roomID := e.group(t, "private", alice)
+	e.message(t, roomID, alice, "secret")
+
+	room := strconv.Itoa(roomID)
+	cases := []struct {
+		name, method, target string
+		h                    http.Handler
+	}{
+		{"GetMessages", http.MethodGet, "/messages?room=" + room, GetMessagesHandler(e.db, e.tokens, e.authz)},
+		{"GetRoomDetail", http.MethodGet, "/rooms/" + room, GetRoomDetailHandler(e.db, e.tokens, e.authz)},
+		{"GetFullReadStatus", http.MethodGet, "/read_status_full?room=" + room, GetFullReadStatusHandler(e.db, e.tokens, e.authz)},
+		{"GetUnreadCount", http.MethodGet, "/unread_count?room=" + room, GetUnreadCountHandler(e.db, e.tokens, e.authz)},
+		{"MarkAllAsRead", http.MethodPost, "/mark_all_read?room=" + room, MarkAllAsReadHandler(e.db, e.tokens, e.hub, e.authz)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if rec := serve(t, c.h, c.method, c.target, malloryToken, nil); rec.Code != http.StatusForbidden {
+				t.Errorf("非メンバー: status = %d, want 403", rec.Code)
+			}
+			if rec := serve(t, c.h, c.method, c.target, aliceToken, nil); rec.Code != http.StatusOK {
+				t.Errorf("メンバー: status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebSocketRejectsNonMemberMessage(t *testing.T) {
+	e := newTestEnv(t)
+	alice, _ := e.user(t, "alice")
+	_, malloryToken := e.user(t, "mallory")
+	roomID := e.group(t, "private", alice)
+
+	srv := httptest.NewServer(WebSocketHandler(e.db, e.tokens, e.hub, e.authz))
+	defer srv.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{bearerSubprotocol, malloryToken}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal("接続失敗:", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var ev map[string]interface{}
+	if err := conn.ReadJSON(&ev); err != nil || ev["type"] != "authenticated" {
+		t.Fatalf("最初のフレーム = %v (%v), want authenticated", ev, err)
+	}
+
+	if err := conn.WriteJSON(WSMessage{Type: "message", RoomID: roomID, Text: "let me in"}); err != nil {
+		t.Fatal(err)
+	}
+	ev = nil
+	if err := conn.ReadJSON(&ev); err != nil || ev["type"] != "error" {
+		t.Fatalf("応答 = %v (%v), want error", ev, err)
+	}
+
+	var n int
+	if err := e.db.QueryRow(context.Background(), `SELECT COUNT(*) FROM messages WHERE room_id = $1`, roomID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("メッセージが %d 件保存された", n)
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"backend/config"
+	"backend/migrations"
+	"backend/utils"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// DB を使うテストの共通部分
+// TEST_DATABASE_URL と TEST_REDIS_ADDR が設定されているときだけ実行する（中身は毎回消すので専用のDBを使うこと）
+type testEnv struct {
+	db     *pgxpool.Pool
+	tokens *utils.TokenManager
+	hub    *Hub
+	authz  *RoomAuthorizer
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+	dbURL, redisAddr := os.Getenv("TEST_DATABASE_URL"), os.Getenv("TEST_REDIS_ADDR")
+	if dbURL == "" || redisAddr == "" {
+		t.Skip("TEST_DATABASE_URL と TEST_REDIS_ADDR が未設定")
+	}
+	ctx := context.Background()
+
+	db, err := pgxpool.New(ctx, dbURL)
+	if err != nil {
+		t.Fatal("DB接続失敗:", err)
+	}
+	t.Cleanup(db.Close)
+	if _, err := migrations.Up(ctx, db); err != nil {
+		t.Fatal("マイグレーション失敗:", err)
+	}
+	// users と chat_rooms から辿れる行はまとめて消える
+	if _, err := db.Exec(ctx, `TRUNCATE users, chat_rooms RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatal("テーブル初期化失敗:", err)
+	}
+
+	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
+	t.Cleanup(func() { rdb.Close() })
+
+	tokens := utils.NewTokenManager(config.Default().JWT, db, rdb)
+	if err := tokens.InitSigningKeys(ctx); err != nil {
+		t.Fatal("署名鍵の準備失敗:", err)
+	}
+
+	hub := NewHub(nil)
+	go hub.Run()
+	authz := NewRoomAuthorizer(db)
+	hub.OnMembershipChange(authz.Invalidate)
+
+	return &testEnv{db: db, tokens: tokens, hub: hub, authz: authz}
+}
+
+// ユーザーを作り、ID とアクセストークンを返す
+func (e *testEnv) user(t *testing.T, username string) (int, string) {
+	t.Helper()
+	var id int
+	err := e.db.QueryRow(context.Background(),
+		`INSERT INTO users (username, username_key, password_hash) VALUES ($1, lower($1), 'x') RETURNING id`, username).Scan(&id)
+	if err != nil {
+		t.Fatal("ユーザー作成失敗:", err)
+	}
+	token, _, err := e.tokens.GenerateJWT(id, username, uuid.New().String())
+	if err != nil {
+		t.Fatal("トークン生成失敗:", err)
+	}
+	return id, token
+}
+
+// グループを作る。members の先頭がオーナー
+func (e *testEnv) group(t *testing.T, name string, members ...int) int {
+	t.Helper()
+	ctx := context.Background()
+	var roomID int
+	err := e.db.QueryRow(ctx,
+		`INSERT INTO chat_rooms (is_group, room_name) VALUES (true, $1) RETURNING id`, name).Scan(&roomID)
+	if err != nil {
+		t.Fatal("ルーム作成失敗:", err)
+	}
+	for i, uid := range members {
+		role := roleMember
+		if i == 0 {
+			role = roleOwner
+		}
+		_, err := e.db.Exec(ctx,
+			`INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3)`, roomID, uid, role)
+		if err != nil {
+			t.Fatal("メンバー追加失敗:", err)
+		}
+	}
+	return roomID
+}
+
+func (e *testEnv) message(t *testing.T, roomID, senderID int, text string) int {
+	t.Helper()
+	var id int
+	err := e.db.QueryRow(context.Background(),
+		`INSERT INTO messages (room_id, sender_id, text) VALUES ($1, $2, $3) RETURNING id`,
+		roomID, senderID, text).Scan(&id)
+	if err != nil {
+		t.Fatal("メッセージ作成失敗:", err)
+	}
+	return id
+}
+
+// token 付きでハンドラーを呼ぶ。body が nil でなければ JSON にして送る
+func serve(t *testing.T, h http.Handler, method, target, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, target, rd)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
@@ -0,0 +1,422 @@
+// WebSocketハブ
+// 1ユーザー1接続で、所属する全ルームのイベントをまとめて配信する。
+// クライアント管理は1つのgoroutineに集約し、各クライアントへの書き込みは
+// 専用のwriter goroutineだけが行う。複数インスタンス間の中継は pubsub.go
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	writeWait      = 10 * time.Second    // 1回の書き込みにかけてよい時間
+	pongWait       = 60 * time.Second    // pongが来なければ切断するまでの時間
+	pingPeriod     = (pongWait * 9) / 10 // pingの送信間隔（pongWaitより短く）
+	maxMessageSize = 64 * 1024           // 受信フレームの上限
+	sendBufferSize = 256                 // クライアントごとの送信キュー長
+	authTimeout    = 10 * time.Second    // 接続後、最初の auth フレームを待つ時間
+	expiryCheck    = 5 * time.Second     // トークン期限切れの接続を探す間隔
+)
+
+type Client struct {
+	hub       *Hub
+	Conn      *websocket.Conn
+	UserID    int
+	Username  string
+	SessionID string // 接続に使ったアクセストークンの sid
+	send      chan []byte
+
+	// 以下はハブのgoroutineからのみ触る
+	rooms     map[int]bool // 所属ルーム（room_members）
+	focused   map[int]bool // subscribe で表示中のルーム
+	expiresAt time.Time    // アクセストークンの期限。過ぎたら切断する（auth フレームで延長できる）
+}
+
+// 配信イベント（JSONエンコード済み）
+type hubEvent struct {
+	roomID  int  // ルーム宛て
+	userID  int  // 0 以外ならそのユーザーの全接続宛て
+	focused bool // true なら roomID を subscribe 中の接続だけに送る
+	payload []byte
+}
+
+type subscription struct {
+	client *Client
+	roomID int
+	on     bool
+}
+
+type membership struct {
+	userID int
+	roomID int
+	joined bool
+}
+
+// セッションの失効。そのセッションの接続を切る
+type revocation struct {
+	userID    int
+	sessionID string
+}
+
+// 接続中の再認証で延びたトークン期限
+type reauthentication struct {
+	client    *Client
+	expiresAt time.Time
+}
+
+// 特定の接続だけに送るもの（エラー通知など）
+type directMessage struct {
+	client  *Client
+	payload []byte
+}
+
+type Hub struct {
+	instanceID string
+	rdb        *redis.Client // nil ならこのインスタンス内だけで配信する
+
+	users map[int]map[*Client]bool // userID → 接続
+	rooms map[int]map[*Client]bool // roomID → メンバーの接続
+
+	// メンバー変更時に呼ばれる（他インスタンスからの変更も含む）。Run の前に設定する
+	onMembership func(userID, roomID int)
+
+	register    chan *Client
+	unregister  chan *Client
+	subscribe   chan subscription
+	members     chan membership
+	broadcast   chan hubEvent
+	direct      chan directMessage
+	revocations chan revocation
+	reauths     chan reauthentication
+}
+
+func NewHub(rdb *redis.Client) *Hub {
+	return &Hub{
+		instanceID:  uuid.New().String(),
+		rdb:         rdb,
+		users:       make(map[int]map[*Client]bool),
+		rooms:       make(map[int]map[*Client]bool),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		subscribe:   make(chan subscription, sendBufferSize),
+		members:     make(chan membership, sendBufferSize),
+		broadcast:   make(chan hubEvent, sendBufferSize),
+		direct:      make(chan directMessage, sendBufferSize),
+		revocations: make(chan revocation, sendBufferSize),
+		reauths:     make(chan reauthentication, sendBufferSize),
+	}
+}
+
+func (h *Hub) OnMembershipChange(fn func(userID, roomID int)) {
+	h.onMembership = fn
+}
+
+// ハブのメインループ。users / rooms / Client の rooms・focused はこのgoroutineからしか触らない
+func (h *Hub) Run() {
+	if h.rdb != nil {
+		go h.listen(context.Background())
+	}
+
+	expiry := time.NewTicker(expiryCheck)
+	defer expiry.Stop()
+
+	for {
+		select {
+		case c := <-h.register:
+			addClient(h.users, c.UserID, c)
+			for roomID := range c.rooms {
+				addClient(h.rooms, roomID, c)
+			}
+			log.Printf("ユーザー %s が接続（所属ルーム %d 件）", c.Username, len(c.rooms))
+
+		case c := <-h.unregister:
+			h.remove(c)
+
+		case s := <-h.subscribe:
+			h.applySubscription(s)
+
+		case m := <-h.members:
+			h.applyMembership(m)
+
+		case ev := <-h.broadcast:
+			h.deliver(ev)
+
+		case d := <-h.direct:
+			if h.users[d.client.UserID][d.client] {
+				h.sendTo(d.client, d.payload)
+			}
+
+		case rv := <-h.revocations:
+			h.disconnectSession(rv)
+
+		case ra := <-h.reauths:
+			if h.users[ra.client.UserID][ra.client] {
+				ra.client.expiresAt = ra.expiresAt
+			}
+
+		case now := <-expiry.C:
+			h.expireClients(now)
+		}
+	}
+}
+
+func (h *Hub) deliver(ev hubEvent) {
+	var targets map[*Client]bool
+	if ev.userID != 0 {
+		targets = h.users[ev.userID]
+	} else {
+		targets = h.rooms[ev.roomID]
+	}
+
+	for c := range targets {
+		if ev.focused && !c.focused[ev.roomID] {
+			continue
+		}
+		h.sendTo(c, ev.payload)
+	}
+}
+
+func (h *Hub) sendTo(c *Client, payload []byte) {
+	select {
+	case c.send <- payload:
+	default:
+		// 送信キューが溢れた遅いクライアントは切断する
+		log.Printf("送信キュー溢れのためクライアントを切断: %s", c.Username)
+		h.remove(c)
+	}
+}
+
+func (h *Hub) applySubscription(s subscription) {
+	c := s.client
+	if !h.users[c.UserID][c] {
+		return // 既に切断済み
+	}
+	if !s.on {
+		delete(c.focused, s.roomID)
+		return
+	}
+	if !c.rooms[s.roomID] {
+		h.sendTo(c, errorPayload("このルームのメンバーではありません"))
+		return
+	}
+	c.focused[s.roomID] = true
+}
+
+// ルームへの参加・退出をその場の接続に反映する
+func (h *Hub) applyMembership(m membership) {
+	if h.onMembership != nil {
+		h.onMembership(m.userID, m.roomID)
+	}
+	for c := range h.users[m.userID] {
+		if m.joined {
+			c.rooms[m.roomID] = true
+			addClient(h.rooms, m.roomID, c)
+		} else {
+			delete(c.rooms, m.roomID)
+			delete(c.focused, m.roomID)
+			removeClient(h.rooms, m.roomID, c)
+		}
+	}
+}
+
+// 失効したセッションの接続に通知してから切断する
+func (h *Hub) disconnectSession(rv revocation) {
+	for c := range h.users[rv.userID] {
+		if c.SessionID != rv.sessionID {
+			continue
+		}
+		log.Printf("セッション失効のためクライアントを切断: %s", c.Username)
+		h.sendTo(c, typedPayload("session_revoked"))
+		h.remove(c)
+	}
+}
+
+// トークンの期限が切れた接続を切断する
+func (h *Hub) expireClients(now time.Time) {
+	for _, clients := range h.users {
+		for c := range clients {
+			if c.expiresAt.IsZero() || now.Before(c.expiresAt) {
+				continue
+			}
+			log.Printf("トークン期限切れのためクライアントを切断: %s", c.Username)
+			h.sendTo(c, typedPayload("token_expired"))
+			h.remove(c)
+		}
+	}
+}
+
+func (h *Hub) remove(c *Client) {
+	if !h.users[c.UserID][c] {
+		return
+	}
+	removeClient(h.users, c.UserID, c)
+	for roomID := range c.rooms {
+		removeClient(h.rooms, roomID, c)
+	}
+	close(c.send)
+}
+
+func typedPayload(typ string) []byte {
+	payload, _ := json.Marshal(map[string]string{"type": typ})
+	return payload
+}
+
+func errorPayload(message string) []byte {
+	payload, _ := json.Marshal(map[string]string{"type": "error", "message": message})
+	return payload
+}
+
+func addClient(index map[int]map[*Client]bool, key int, c *Client) {
+	if index[key] == nil {
+		index[key] = make(map[*Client]bool)
+	}
+	index[key][c] = true
+}
+
+func removeClient(index map[int]map[*Client]bool, key int, c *Client) {
+	clients := index[key]
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(index, key)
+	}
+}
+
+// ルームのメンバー全員の接続にJSONを送る
+func (h *Hub) Broadcast(roomID int, v interface{}) {
+	h.enqueue(hubEvent{roomID: roomID}, v)
+}
+
+// ルームを subscribe 中の接続だけにJSONを送る（既読・入退室など表示中にしか要らないもの）
+func (h *Hub) BroadcastFocused(roomID int, v interface{}) {
+	h.enqueue(hubEvent{roomID: roomID, focused: true}, v)
+}
+
+// 特定ユーザーの全接続にJSONを送る
+func (h *Hub) SendToUser(userID int, v interface{}) {
+	h.enqueue(hubEvent{userID: userID}, v)
+}
+
+// ルームに参加したユーザーの接続にも、以後そのルームのイベントを流す
+func (h *Hub) JoinRoom(userID, roomID int) {
+	h.changeMembership(membership{userID: userID, roomID: roomID, joined: true})
+}
+
+func (h *Hub) LeaveRoom(userID, roomID int) {
+	h.changeMembership(membership{userID: userID, roomID: roomID, joined: false})
+}
+
+// セッションの接続を全インスタンスで切断する
+func (h *Hub) DisconnectSession(userID int, sessionID string) {
+	rv := revocation{userID: userID, sessionID: sessionID}
+	h.revocations <- rv
+	h.publishRevocation(rv)
+}
+
+func (h *Hub) changeMembership(m membership) {
+	h.members <- m
+	h.publishMembership(m)
+}
+
+func (h *Hub) enqueue(ev hubEvent, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Println("ブロードキャストのエンコード失敗:", err)
+		return
+	}
+	ev.payload = payload
+	h.broadcast <- ev
+	h.publishEvent(ev)
+}
+
+func newClient(h *Hub, conn *websocket.Conn, userID int, username, sessionID string, expiresAt time.Time, rooms []int) *Client {
+	c := &Client{
+		hub:       h,
+		Conn:      conn,
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
+		send:      make(chan []byte, sendBufferSize),
+		rooms:     make(map[int]bool, len(rooms)),
+		focused:   make(map[int]bool),
+		expiresAt: expiresAt,
+	}
+	for _, id := range rooms {
+		c.rooms[id] = true
+	}
+	return c
+}
+
+func (c *Client) Subscribe(roomID int) {
+	c.hub.subscribe <- subscription{client: c, roomID: roomID, on: true}
+}
+
+func (c *Client) Unsubscribe(roomID int) {
+	c.hub.subscribe <- subscription{client: c, roomID: roomID, on: false}
+}
+
+// この接続だけにエラーを返す
+func (c *Client) SendError(message string) {
+	c.hub.direct <- directMessage{client: c, payload: errorPayload(message)}
+}
+
+// この接続だけにJSONを送る
+func (c *Client) Send(v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Println("送信データのエンコード失敗:", err)
+		return
+	}
+	c.hub.direct <- directMessage{client: c, payload: payload}
+}
+
+// 再認証でトークンの期限を延ばす
+func (c *Client) Reauthenticate(expiresAt time.Time) {
+	c.hub.reauths <- reauthentication{client: c, expiresAt: expiresAt}
+}
+
+// 受信側の設定。pongを受け取るたびに読み込み期限を延ばす
+func (c *Client) prepareRead() {
+	c.Conn.SetReadLimit(maxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+// 送信キューの中身とpingを書き込む。Connへの書き込みはここだけ
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
+
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// ハブがキューを閉じた
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.Conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				log.Println("WebSocket書き込み失敗:", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
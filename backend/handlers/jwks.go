@@ -0,0 +1,22 @@
+// 他のサービスがアクセストークンを検証するための公開鍵
+package handlers
+
+import (
+	"backend/utils"
+	"encoding/json"
+	"net/http"
+)
+
+// GET /.well-known/jwks.json
+// 新しい鍵は使い始める1時間前から載るので、キャッシュは短めにしてもらう
+func JWKSHandler(tokens *utils.TokenManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(tokens.JWKS())
+	}
+}
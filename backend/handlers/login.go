@@ -2,18 +2,33 @@
 package handlers
 
 import (
-	"context"      //タイムアウトやキャンセル制御
-	"database/sql" //SQLエラーで使用
+	"context" //タイムアウトやキャンセル制御
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 
-	"backend/utils" //JWT生成などのユーティリティ関数を利用(GenarateJWTとか)
+	"backend/utils"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ユーザーの有無が応答から分からないよう、失敗時の文言は1つにする
+const loginFailedMessage = "ユーザー名またはパスワードが間違っています"
+
+// 存在しないユーザーでも bcrypt の比較を1回行い、応答時間でユーザーの有無が分からないようにする
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+	return hash
+})
+
 // クライアントから送られてくるログイン情報を表す構造体
 type Credentials struct {
 	Username string `json:"username"`
@@ -21,7 +36,7 @@ type Credentials struct {
 }
 
 // ログイン処理
-func LoginHandler(db *pgxpool.Pool) http.HandlerFunc {
+func LoginHandler(db *pgxpool.Pool, tokens *utils.TokenManager, rdb *redis.Client, guard *LoginGuard) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		//リクエストの読み込みとパース
 		var creds Credentials
@@ -30,44 +45,98 @@ func LoginHandler(db *pgxpool.Pool) http.HandlerFunc {
 			http.Error(w, "無効なリクエスト", http.StatusBadRequest)
 			return
 		}
+		creds.Username = normalizeUsername(creds.Username)
 		log.Println("ログイン試行:", creds.Username)
+		ip := clientIP(r)
+
+		//試行回数の制限
+		if wait := guard.RetryAfter(r.Context(), creds.Username, ip); wait > 0 {
+			recordLoginFailure(db, r, creds.Username, 0, "throttled")
+			writeThrottled(w, wait)
+			return
+		}
 
 		//ユーザー情報の検索
+		var userID int
 		var hashedPassword string
-		err := db.QueryRow(context.Background(), "SELECT password_hash FROM users WHERE username=$1", creds.Username).Scan(&hashedPassword)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				log.Println("ユーザーが存在しません:", creds.Username)
-				http.Error(w, "ユーザーが存在しません", http.StatusUnauthorized)
-			} else {
-				log.Println("SQLエラー:", err)
-				http.Error(w, "サーバーエラー", http.StatusInternalServerError)
-			}
+		err := db.QueryRow(context.Background(), "SELECT id, password_hash FROM users WHERE username=$1", creds.Username).Scan(&userID, &hashedPassword)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			log.Println("SQLエラー:", err)
+			http.Error(w, "サーバーエラー", http.StatusInternalServerError)
 			return
 		}
+		userExists := err == nil
+		if !userExists {
+			hashedPassword = string(dummyPasswordHash())
+		}
 
 		//パスワード照合
-		if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(creds.Password)); err != nil {
-			log.Println("パスワード不一致:", creds.Username)
-			http.Error(w, "パスワードが間違っています", http.StatusUnauthorized)
+		if err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(creds.Password)); err != nil || !userExists {
+			reason := "bad_password"
+			if !userExists {
+				reason = "unknown_user"
+			}
+			log.Printf("ログイン失敗(%s): %s", reason, creds.Username)
+			guard.Fail(r.Context(), creds.Username, ip)
+			recordLoginFailure(db, r, creds.Username, userID, reason)
+			http.Error(w, loginFailedMessage, http.StatusUnauthorized)
 			return
 		}
+		// 失敗回数は2段階認証まで通ってセッションを発行するまで消さない
 		log.Println("パスワード認証成功:", creds.Username)
 
-		//JWTトークン生成
-		token, err := utils.GenerateJWT(creds.Username)
+		//2段階認証が有効なら、コード確認用の事前認証トークンだけを返す（/login/2fa）
+		enabled, err := totpEnabled(r.Context(), db, userID)
+		if err != nil {
+			log.Println("2段階認証の状態取得失敗:", err)
+			http.Error(w, "サーバーエラー", http.StatusInternalServerError)
+			return
+		}
+		if enabled {
+			challenge, err := beginPreAuth(r.Context(), rdb, userID, creds.Username)
+			if err != nil {
+				log.Println("事前認証トークン生成失敗:", err)
+				http.Error(w, "トークン生成失敗", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(challenge)
+			return
+		}
+
+		//アクセストークンとリフレッシュトークンの発行
+		res, err := startSession(r.Context(), db, tokens, userID, creds.Username, r.UserAgent(), clientIP(r))
 		if err != nil {
 			log.Printf("トークン生成失敗:%+v\n", err)
 			http.Error(w, "トークン生成失敗", http.StatusInternalServerError)
 			return
 		}
-		log.Println("トークン生成成功:", token)
+		guard.Succeed(r.Context(), creds.Username)
+		log.Println("トークン生成成功:", creds.Username)
 
 		//トークンをクライアントに返す
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
-			"token": token,
-		})
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// 試行回数の制限にかかったときの 429
+func writeThrottled(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "ログイン試行回数が多すぎます。しばらくしてから再度お試しください", http.StatusTooManyRequests)
+}
+
+// 失敗したログインを監査用に残す。userID が 0 なら存在しないユーザー
+func recordLoginFailure(db *pgxpool.Pool, r *http.Request, username string, userID int, reason string) {
+	var uid *int
+	if userID != 0 {
+		uid = &userID
+	}
+	_, err := db.Exec(context.Background(),
+		`INSERT INTO login_failures (username, user_id, ip, user_agent, reason) VALUES ($1, $2, $3, $4, $5)`,
+		username, uid, clientIP(r), r.UserAgent(), reason)
+	if err != nil {
+		log.Println("ログイン失敗の記録失敗:", err)
 	}
 }
 
@@ -2,40 +2,34 @@ package handlers
 
 import (
 	"backend/utils"
+	"log"
 	"net/http"
-	"strings"
-	"time"
 
-	"github.com/golang-jwt/jwt"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorizationヘッダーがありません", http.StatusUnauthorized)
-		return
-	}
-	tokenStr := strings.Split(authHeader, " ")[1]
-
-	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return utils.GetJWTSecret(), nil
-	})
-	if err != nil {
-		http.Error(w, "トークンが不正です", http.StatusUnauthorized)
-		return
-	}
+// アクセストークンと、同じセッションのリフレッシュトークンをまとめて失効させる
+func LogoutHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := tokens.ClaimsFromRequest(r)
+		if err != nil {
+			http.Error(w, "トークンが不正です", http.StatusUnauthorized)
+			return
+		}
 
-	jti := claims["jti"].(string)
-	expUnix := int64(claims["exp"].(float64))
-	ttl := time.Until(time.Unix(expUnix, 0))
+		if err := tokens.BlacklistToken(r.Context(), claims); err != nil {
+			http.Error(w, "トークン失効に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		if claims.SessionID != "" {
+			if err := revokeSession(r.Context(), db, tokens, hub, claims.SessionID); err != nil {
+				log.Println("リフレッシュトークン失効失敗:", err)
+				http.Error(w, "トークン失効に失敗しました", http.StatusInternalServerError)
+				return
+			}
+		}
 
-	err = utils.RedisClient.Set(utils.Ctx, "blacklist:"+jti, "1", ttl).Err()
-	if err != nil {
-		http.Error(w, "トークン失効に失敗しました", http.StatusInternalServerError)
-		return
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ログアウトしました"))
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("ログアウトしました"))
 }
@@ -7,14 +7,16 @@ import (
 	"net/http"
 )
 
-func MeHandler(w http.ResponseWriter, r *http.Request) {
-	username, err := utils.ParseJWTFromRequest(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+func MeHandler(tokens *utils.TokenManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
 
-	json.NewEncoder(w).Encode(map[string]string{
-		"username": username,
-	})
+		json.NewEncoder(w).Encode(map[string]string{
+			"username": username,
+		})
+	}
 }
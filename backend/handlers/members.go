@@ -0,0 +1,541 @@
+// グループのメンバー管理（追加・削除・退出・役割の変更）
+// 変更はシステムメッセージとして messages に残し、WebSocket でも通知する
+package handlers
+
+import (
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// room_members.role
+const (
+	roleOwner  = "owner"
+	roleAdmin  = "admin"
+	roleMember = "member"
+)
+
+// messages.kind
+const (
+	messageKindUser   = "user"
+	messageKindSystem = "system"
+)
+
+const maxAddMembers = 50
+
+var (
+	errRoomNotFound  = errors.New("ルームが見つかりません")
+	errNotGroup      = errors.New("1対1のルームでは変更できません")
+	errNotRoomMember = errors.New("このルームへのアクセス権がありません")
+	errMemberDenied  = errors.New("この操作をする権限がありません")
+	errMemberMissing = errors.New("メンバーが見つかりません")
+)
+
+type RoomMember struct {
+	UserID            int    `json:"user_id"`
+	Username          string `json:"username"`
+	Role              string `json:"role"`
+	LastReadMessageID *int   `json:"last_read_message_id,omitempty"` // 既読カーソル（一覧の取得時だけ付く）
+}
+
+// システムメッセージの中身（クライアントが文言を組み立て直せるように）
+type SystemEvent struct {
+	Action  string   `json:"action"` // "members_added", "member_removed", "member_left", "role_changed", "owner_transferred", "room_renamed" など
+	Actor   string   `json:"actor"`
+	Targets []string `json:"targets,omitempty"`
+	Role    string   `json:"role,omitempty"`
+	Name    string   `json:"name,omitempty"` // 変更後のグループ名
+}
+
+type AddMembersRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+// GET    /rooms/{id}/members              メンバー一覧
+// POST   /rooms/{id}/members              {"usernames": [...]} 追加（owner/admin）
+// PATCH  /rooms/{id}/members/{user_id}    {"role": "admin"|"member"|"owner"} 役割の変更（owner）。"owner" なら譲渡
+// DELETE /rooms/{id}/members/{user_id}    削除（owner/admin）。{user_id} が me なら退出
+func RoomMembersHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "認証エラー", http.StatusUnauthorized)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+			return
+		}
+
+		roomID, sub, err := parseRoomPath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "ルームIDが無効です", http.StatusBadRequest)
+			return
+		}
+		target := strings.TrimPrefix(strings.TrimPrefix(sub, "members"), "/")
+
+		actor := RoomMember{UserID: userID, Username: username}
+		switch {
+		case target == "" && r.Method == http.MethodGet:
+			if !authz.Require(w, r, roomID, userID) {
+				return
+			}
+			members, err := listRoomMembers(r.Context(), db, roomID)
+			if err != nil {
+				log.Println("メンバー取得失敗:", err)
+				http.Error(w, "メンバー取得失敗", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(members)
+
+		case target == "" && r.Method == http.MethodPost:
+			addMembers(w, r, db, hub, roomID, actor)
+
+		case target != "" && (r.Method == http.MethodPatch || r.Method == http.MethodDelete):
+			targetID := userID
+			if target != "me" {
+				if targetID, err = strconv.Atoi(target); err != nil {
+					http.Error(w, "ユーザーIDが無効です", http.StatusBadRequest)
+					return
+				}
+			}
+			if r.Method == http.MethodPatch {
+				updateMemberRole(w, r, db, hub, roomID, actor, targetID)
+			} else {
+				removeMember(w, r, db, hub, roomID, actor, targetID)
+			}
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func addMembers(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, hub *Hub, roomID int, actor RoomMember) {
+	var req AddMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Usernames) == 0 {
+		http.Error(w, "追加するユーザーを指定してください", http.StatusBadRequest)
+		return
+	}
+	if len(req.Usernames) > maxAddMembers {
+		http.Error(w, "一度に追加できるのは50人までです", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	role, err := lockGroupRoom(ctx, tx, roomID, actor.UserID)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	if err := lockActiveRoom(ctx, tx, roomID); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	if role != roleOwner && role != roleAdmin {
+		writeMemberError(w, errMemberDenied)
+		return
+	}
+
+	rows, err := tx.Query(ctx, `SELECT id, username FROM users WHERE username = ANY($1)`, req.Usernames)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	names := make(map[int]string, len(req.Usernames))
+	found := make(map[string]bool, len(req.Usernames))
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			writeMemberError(w, err)
+			return
+		}
+		names[id] = name
+		found[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	for _, name := range req.Usernames {
+		if !found[name] {
+			http.Error(w, "ユーザーが見つかりません: "+name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ids := make([]int, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	rows, err = tx.Query(ctx,
+		`INSERT INTO room_members (room_id, user_id, role, last_read_message_id)
+		 SELECT $1, id, 'member', (SELECT MAX(m.id) FROM messages m WHERE m.room_id = $1)
+		 FROM unnest($2::int[]) AS id
+		 ON CONFLICT DO NOTHING
+		 RETURNING user_id`,
+		roomID, ids)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	addedIDs, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+
+	// 既にメンバーだった人は除き、指定された順に並べる
+	addedByName := make(map[string]int, len(addedIDs))
+	for _, id := range addedIDs {
+		addedByName[names[id]] = id
+	}
+	added := make([]RoomMember, 0, len(addedIDs))
+	targets := make([]string, 0, len(addedIDs))
+	for _, name := range req.Usernames {
+		id, ok := addedByName[name]
+		if !ok {
+			continue
+		}
+		delete(addedByName, name)
+		added = append(added, RoomMember{UserID: id, Username: name, Role: roleMember})
+		targets = append(targets, name)
+	}
+
+	var sysMsg *WSMessage
+	if len(added) > 0 {
+		ev := SystemEvent{Action: "members_added", Actor: actor.Username, Targets: targets}
+		text := actor.Username + "さんが" + strings.Join(targets, "さん、") + "さんを追加しました"
+		if sysMsg, err = insertSystemMessage(ctx, tx, roomID, actor, ev, text); err != nil {
+			writeMemberError(w, err)
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+
+	for _, m := range added {
+		hub.JoinRoom(m.UserID, roomID)
+		hub.SendToUser(m.UserID, map[string]interface{}{
+			"type":    "room_joined",
+			"room_id": roomID,
+		})
+	}
+	if sysMsg != nil {
+		hub.Broadcast(roomID, sysMsg)
+		hub.Broadcast(roomID, map[string]interface{}{
+			"type":    "members_added",
+			"room_id": roomID,
+			"members": added,
+			"by":      actor.Username,
+		})
+	}
+	log.Printf("ルーム%d: %s が %d 人を追加", roomID, actor.Username, len(added))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"added": added})
+}
+
+func removeMember(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, hub *Hub, roomID int, actor RoomMember, targetID int) {
+	ctx := r.Context()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	role, err := lockGroupRoom(ctx, tx, roomID, actor.UserID)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	if err := lockActiveRoom(ctx, tx, roomID); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	target, err := roomMember(ctx, tx, roomID, targetID)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+
+	leaving := targetID == actor.UserID
+	var ev SystemEvent
+	var text string
+	if leaving {
+		// オーナーは他のメンバーがいる間は譲渡してからでないと抜けられない
+		if role == roleOwner {
+			var others int
+			err := tx.QueryRow(ctx,
+				`SELECT COUNT(*) FROM room_members WHERE room_id = $1 AND user_id <> $2`,
+				roomID, actor.UserID).Scan(&others)
+			if err != nil {
+				writeMemberError(w, err)
+				return
+			}
+			if others > 0 {
+				http.Error(w, "オーナーは他のメンバーにオーナーを譲ってから退出してください", http.StatusConflict)
+				return
+			}
+		}
+		ev = SystemEvent{Action: "member_left", Actor: actor.Username}
+		text = actor.Username + "さんが退出しました"
+	} else {
+		// オーナーは誰でも、管理者は一般メンバーだけ削除できる
+		if !(role == roleOwner || (role == roleAdmin && target.Role == roleMember)) {
+			writeMemberError(w, errMemberDenied)
+			return
+		}
+		ev = SystemEvent{Action: "member_removed", Actor: actor.Username, Targets: []string{target.Username}}
+		text = actor.Username + "さんが" + target.Username + "さんを削除しました"
+	}
+
+	if _, err := tx.Exec(ctx,
+		`DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`, roomID, targetID); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	sysMsg, err := insertSystemMessage(ctx, tx, roomID, actor, ev, text)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+
+	hub.Broadcast(roomID, sysMsg)
+	hub.Broadcast(roomID, map[string]interface{}{
+		"type":     "member_removed",
+		"room_id":  roomID,
+		"user_id":  target.UserID,
+		"username": target.Username,
+		"by":       actor.Username,
+	})
+	// 抜けた人にはルームのイベントが届かなくなるので個別に知らせる
+	hub.LeaveRoom(targetID, roomID)
+	hub.SendToUser(targetID, map[string]interface{}{
+		"type":    "room_left",
+		"room_id": roomID,
+		"removed": !leaving,
+	})
+	log.Printf("ルーム%d: %s (%s)", roomID, text, ev.Action)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func updateMemberRole(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, hub *Hub, roomID int, actor RoomMember, targetID int) {
+	var req UpdateMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "不正なリクエスト形式", http.StatusBadRequest)
+		return
+	}
+	if req.Role != roleOwner && req.Role != roleAdmin && req.Role != roleMember {
+		http.Error(w, "role は owner, admin, member のどれかにしてください", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	role, err := lockGroupRoom(ctx, tx, roomID, actor.UserID)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	if err := lockActiveRoom(ctx, tx, roomID); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	if role != roleOwner {
+		writeMemberError(w, errMemberDenied)
+		return
+	}
+	target, err := roomMember(ctx, tx, roomID, targetID)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	if targetID == actor.UserID {
+		http.Error(w, "自分の役割は変更できません（オーナーは譲渡してください）", http.StatusBadRequest)
+		return
+	}
+	if target.Role == req.Role {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(target)
+		return
+	}
+
+	var ev SystemEvent
+	var text string
+	if req.Role == roleOwner {
+		// 元のオーナーは管理者になる。オーナーは1人だけなので先に降ろす
+		if _, err := tx.Exec(ctx,
+			`UPDATE room_members SET role = 'admin' WHERE room_id = $1 AND user_id = $2`,
+			roomID, actor.UserID); err != nil {
+			writeMemberError(w, err)
+			return
+		}
+		ev = SystemEvent{Action: "owner_transferred", Actor: actor.Username, Targets: []string{target.Username}, Role: roleOwner}
+		text = actor.Username + "さんが" + target.Username + "さんにオーナーを譲りました"
+	} else {
+		ev = SystemEvent{Action: "role_changed", Actor: actor.Username, Targets: []string{target.Username}, Role: req.Role}
+		if req.Role == roleAdmin {
+			text = actor.Username + "さんが" + target.Username + "さんを管理者にしました"
+		} else {
+			text = actor.Username + "さんが" + target.Username + "さんを一般メンバーにしました"
+		}
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE room_members SET role = $3 WHERE room_id = $1 AND user_id = $2`,
+		roomID, targetID, req.Role); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	sysMsg, err := insertSystemMessage(ctx, tx, roomID, actor, ev, text)
+	if err != nil {
+		writeMemberError(w, err)
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeMemberError(w, err)
+		return
+	}
+
+	target.Role = req.Role
+	hub.Broadcast(roomID, sysMsg)
+	hub.Broadcast(roomID, map[string]interface{}{
+		"type":     "member_role_changed",
+		"room_id":  roomID,
+		"user_id":  target.UserID,
+		"username": target.Username,
+		"role":     target.Role,
+		"by":       actor.Username,
+	})
+	log.Printf("ルーム%d: %s", roomID, text)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(target)
+}
+
+// ルームの行をロックしてメンバー変更を直列にし、グループであることと操作者の役割を確かめる
+func lockGroupRoom(ctx context.Context, tx pgx.Tx, roomID, userID int) (string, error) {
+	var isGroup bool
+	err := tx.QueryRow(ctx, `SELECT is_group FROM chat_rooms WHERE id = $1 FOR UPDATE`, roomID).Scan(&isGroup)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errRoomNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	m, err := roomMember(ctx, tx, roomID, userID)
+	if errors.Is(err, errMemberMissing) {
+		return "", errNotRoomMember
+	}
+	if err != nil {
+		return "", err
+	}
+	if !isGroup {
+		return "", errNotGroup
+	}
+	return m.Role, nil
+}
+
+func roomMember(ctx context.Context, tx pgx.Tx, roomID, userID int) (RoomMember, error) {
+	m := RoomMember{UserID: userID}
+	err := tx.QueryRow(ctx,
+		`SELECT u.username, rm.role FROM room_members rm JOIN users u ON u.id = rm.user_id
+		 WHERE rm.room_id = $1 AND rm.user_id = $2`,
+		roomID, userID,
+	).Scan(&m.Username, &m.Role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, errMemberMissing
+	}
+	return m, err
+}
+
+func listRoomMembers(ctx context.Context, db *pgxpool.Pool, roomID int) ([]RoomMember, error) {
+	rows, err := db.Query(ctx, `
+		SELECT u.id, u.username, rm.role, COALESCE(rm.last_read_message_id, 0) FROM room_members rm
+		JOIN users u ON u.id = rm.user_id
+		WHERE rm.room_id = $1
+		ORDER BY CASE rm.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, rm.joined_at, u.id`,
+		roomID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[RoomMember])
+}
+
+// システムメッセージを保存し、WebSocket で流す形にして返す
+func insertSystemMessage(ctx context.Context, tx pgx.Tx, roomID int, actor RoomMember, ev SystemEvent, text string) (*WSMessage, error) {
+	var id int
+	var createdAt time.Time
+	err := tx.QueryRow(ctx,
+		`INSERT INTO messages (room_id, sender_id, text, kind, system_event, created_at)
+		 VALUES ($1, $2, $3, 'system', $4, now()) RETURNING id, created_at`,
+		roomID, actor.UserID, text, ev,
+	).Scan(&id, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return &WSMessage{
+		Type:        "message",
+		RoomID:      roomID,
+		Text:        text,
+		Sender:      actor.UserID,
+		Username:    actor.Username,
+		MessageID:   id,
+		CreatedAt:   createdAt.Format(time.RFC3339),
+		Kind:        messageKindSystem,
+		SystemEvent: &ev,
+	}, nil
+}
+
+func writeMemberError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errRoomNotFound), errors.Is(err, errMemberMissing):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errNotGroup):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errNotRoomMember), errors.Is(err, errMemberDenied):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errRoomArchived):
+		http.Error(w, "アーカイブ中のルームのメンバーは変更できません", http.StatusConflict)
+	default:
+		log.Println("メンバー変更失敗:", err)
+		http.Error(w, "メンバーの変更に失敗しました", http.StatusInternalServerError)
+	}
+}
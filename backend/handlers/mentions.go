@@ -20,9 +20,9 @@ type MentionResponse struct {
 	IsRead     bool   `json:"is_read"`
 }
 
-func GetMentionsHandler(db *pgxpool.Pool) http.HandlerFunc {
+func GetMentionsHandler(db *pgxpool.Pool, tokens *utils.TokenManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -38,12 +38,11 @@ func GetMentionsHandler(db *pgxpool.Pool) http.HandlerFunc {
 
 		rows, err := db.Query(context.Background(), `
   			SELECT m.message_id, msg.room_id, msg.text, msg.created_at, u.username,
-         		   CASE WHEN r.read_at IS NULL THEN false ELSE true END AS is_read
+         		   msg.id <= COALESCE(rm.last_read_message_id, 0) AS is_read
   			FROM mentions m
   			JOIN messages msg ON m.message_id = msg.id
   			JOIN users u ON msg.sender_id = u.id
 			JOIN room_members rm ON rm.room_id = msg.room_id AND rm.user_id = $1
-  			LEFT JOIN message_reads r ON r.message_id = m.message_id AND r.user_id = $1
   			WHERE m.mention_target_id = $1
   			ORDER BY msg.created_at DESC
 		`, userID)
@@ -2,39 +2,208 @@
 package handlers
 
 import (
+	"backend/config"
 	"backend/utils"
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // メッセージ取得用構造体
 type Message struct {
-	ID        int    `json:"id"`
-	SenderID  int    `json:"sender_id"`
-	Username  string `json:"username"`
-	Text      string `json:"text"`
-	CreatedAt string `json:"created_at"`
-	Image     string `json:"image,omitempty"`
-	Deleted   bool   `json:"deleted"`
+	ID          int               `json:"id"`
+	RoomID      int               `json:"room_id"`
+	SenderID    int               `json:"sender_id"`
+	Username    string            `json:"username"`
+	Text        string            `json:"text"`
+	CreatedAt   string            `json:"created_at"`
+	Image       string            `json:"image,omitempty"` // 先頭の添付URLかスタンプのURL（古いクライアント向け）
+	Attachments []Attachment      `json:"attachments"`
+	StampID     *int              `json:"stamp_id,omitempty"`
+	StampURL    string            `json:"stamp_url,omitempty"`
+	Deleted     bool              `json:"deleted"`
+	EditedAt    string            `json:"edited_at,omitempty"`
+	ParentID    *int              `json:"parent_message_id,omitempty"` // スレッド返信なら先頭メッセージのID
+	ReplyCount  int               `json:"reply_count"`
+	Reactions   []ReactionSummary `json:"reactions"`
+	Kind        string            `json:"kind"`                   // "user" か "system"
+	SystemEvent *SystemEvent      `json:"system_event,omitempty"` // kind が "system" のときの中身
+	Reads       *ReadSummary      `json:"reads,omitempty"`        // タイムラインの取得時だけ付く
 }
 
+// Message 1件分のSELECT（m は messages、u は送信者、st はスタンプ）。scanMessage と対で使う
+const messageSelect = `SELECT m.id, m.room_id, m.sender_id, u.username, m.text, ` + attachmentsJSONColumn + `,
+	m.stamp_id, COALESCE(st.file_url, ''), m.created_at, m.deleted, m.edited_at, m.parent_message_id,
+	(SELECT COUNT(*) FROM messages rp WHERE rp.parent_message_id = m.id) AS reply_count,
+	` + reactionsJSONColumn + `, m.kind, m.system_event
+	FROM messages m
+	JOIN users u ON m.sender_id = u.id
+	LEFT JOIN stamps st ON st.id = m.stamp_id`
+
+func scanMessage(row pgx.Row) (Message, error) {
+	var msg Message
+	var createdAt time.Time
+	var editedAt *time.Time
+	err := row.Scan(&msg.ID, &msg.RoomID, &msg.SenderID, &msg.Username, &msg.Text, &msg.Attachments,
+		&msg.StampID, &msg.StampURL, &createdAt, &msg.Deleted, &editedAt, &msg.ParentID, &msg.ReplyCount, &msg.Reactions,
+		&msg.Kind, &msg.SystemEvent)
+	if err != nil {
+		return msg, err
+	}
+	msg.CreatedAt = createdAt.Format(time.RFC3339)
+	msg.Image = legacyImageURL(msg.Attachments, msg.StampURL)
+	if editedAt != nil {
+		msg.EditedAt = editedAt.Format(time.RFC3339)
+	}
+	return msg, nil
+}
+
+// ページング付きのメッセージ一覧
+type MessagePage struct {
+	Messages   []Message `json:"messages"`
+	NextCursor *int      `json:"next_cursor"` // 続きがなければ null
+}
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 200
+)
+
 // 送信リクエスト用構造体
 type SendMessageRequest struct {
-	RoomID int    `json:"room_id"`
-	Text   string `json:"text"`
+	RoomID          int          `json:"room_id"`
+	Text            string       `json:"text"`
+	Attachments     []Attachment `json:"attachments,omitempty"`
+	StampID         int          `json:"stamp_id,omitempty"`
+	ParentMessageID int          `json:"parent_message_id,omitempty"`
+}
+
+// 新規メッセージ（/send と WebSocket の両方から使う）
+type newMessage struct {
+	RoomID      int
+	SenderID    int
+	Text        string
+	Attachments []Attachment
+	StampID     int // 0 ならスタンプなし
+	ParentID    int // 0 ならスレッド返信ではない
+}
+
+// 保存結果
+type createdMessage struct {
+	ID        int
+	CreatedAt time.Time
+	ParentID  int    // 実際にぶら下げたスレッド先頭のID（返信でなければ 0）
+	StampURL  string // スタンプの画像URL
+}
+
+var (
+	errInvalidParent = errors.New("返信先のメッセージが不正です")
+	errRoomArchived  = errors.New("アーカイブされたルームには送信できません")
+)
+
+// メッセージ本体と添付を1トランザクションで保存する
+// 返信先が返信だった場合は、そのスレッドの先頭にぶら下げる
+// スタンプが存在しなければ errInvalidStamp、ルームがアーカイブ済みなら errRoomArchived を返す
+func createMessage(ctx context.Context, db *pgxpool.Pool, m newMessage) (createdMessage, error) {
+	var created createdMessage
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return created, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockActiveRoom(ctx, tx, m.RoomID); err != nil {
+		return created, err
+	}
+
+	var parentID *int
+	if m.ParentID != 0 {
+		var parentRoom, rootID int
+		err := tx.QueryRow(ctx,
+			`SELECT room_id, COALESCE(parent_message_id, id) FROM messages WHERE id = $1`,
+			m.ParentID,
+		).Scan(&parentRoom, &rootID)
+		if err != nil || parentRoom != m.RoomID {
+			return created, errInvalidParent
+		}
+		created.ParentID = rootID
+		parentID = &rootID
+	}
+
+	var stampID *int
+	if m.StampID != 0 {
+		created.StampURL, err = useStamp(ctx, tx, m.SenderID, m.StampID)
+		if err != nil {
+			return created, err
+		}
+		stampID = &m.StampID
+	}
+
+	err = tx.QueryRow(ctx,
+		`INSERT INTO messages (room_id, sender_id, text, parent_message_id, stamp_id, created_at)
+		 VALUES ($1, $2, $3, $4, $5, now()) RETURNING id, created_at`,
+		m.RoomID, m.SenderID, m.Text, parentID, stampID,
+	).Scan(&created.ID, &created.CreatedAt)
+	if err != nil {
+		return created, err
+	}
+
+	if err := insertAttachments(ctx, tx, created.ID, m.Attachments); err != nil {
+		return created, err
+	}
+
+	return created, tx.Commit(ctx)
+}
+
+// 保存したメッセージをルームに流し、メンションを記録して本人に通知する（REST と WebSocket の共通部分）
+// エラーは createMessage と同じ
+func sendMessage(ctx context.Context, db *pgxpool.Pool, hub *Hub, m newMessage, username string) (createdMessage, error) {
+	created, err := createMessage(ctx, db, m)
+	if err != nil {
+		return created, err
+	}
+
+	mentioned := insertMentions(db, m.RoomID, created.ID, m.Text, username)
+
+	msg := WSMessage{
+		Type:        "message",
+		RoomID:      m.RoomID,
+		Text:        m.Text,
+		Image:       legacyImageURL(m.Attachments, created.StampURL),
+		Attachments: m.Attachments,
+		StampID:     m.StampID,
+		StampURL:    created.StampURL,
+		Sender:      m.SenderID,
+		Username:    username,
+		MessageID:   created.ID,
+		ParentID:    created.ParentID,
+		CreatedAt:   created.CreatedAt.Format(time.RFC3339),
+		Kind:        messageKindUser,
+	}
+	hub.Broadcast(m.RoomID, msg)
+	notifyMentions(hub, mentioned, msg)
+	return created, nil
 }
 
 // メッセージの取得ハンドラー
-func GetMessagesHandler(db *pgxpool.Pool) http.HandlerFunc {
+// GET /messages?room=…&limit=…           最新のページ
+// GET /messages?room=…&before=<id>&limit=… id より古いページ（next_cursor は次の before）
+// GET /messages?room=…&after=<id>&limit=…  id より新しいページ（next_cursor は次の after）
+// どの場合もページ内は古い順
+func GetMessagesHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		//認証チェック
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			log.Println("JWT検証失敗:", err)
 			http.Error(w, "認証エラー", http.StatusUnauthorized)
@@ -50,50 +219,138 @@ func GetMessagesHandler(db *pgxpool.Pool) http.HandlerFunc {
 			return
 		}
 
-		//データベースクエリと整形
-		rows, err := db.Query(
-			context.Background(),
-			`SELECT m.id, m.sender_id, u.username, m.text,COALESCE(a.file_url, '') as image, m.created_at, m.deleted
-			 FROM messages m
-			 JOIN users u ON m.sender_id = u.id
-			 LEFT JOIN message_attachments a ON m.id = a.message_id
-			 WHERE m.room_id = $1
-			 ORDER BY m.created_at ASC`, roomID,
-		)
+		//メンバー確認
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+
+		//ページングパラメータ
+		p, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		//スレッド返信はタイムラインに出さない（reply_count と /messages/{id}/thread で見る）
+		page, err := queryMessagePage(r.Context(), db, "m.room_id = $1 AND m.parent_message_id IS NULL", roomID, p)
 		if err != nil {
 			log.Println("メッセージ取得失敗:", err)
 			http.Error(w, "メッセージ取得に失敗しました", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		//メッセージを取得
-		var messages []Message
-		for rows.Next() {
-			var msg Message
-			var createdAt time.Time
-			var deleted bool
-			err := rows.Scan(&msg.ID, &msg.SenderID, &msg.Username, &msg.Text, &msg.Image, &createdAt, &deleted)
-			if err != nil {
-				log.Println("行スキャン失敗:", err)
-				continue
-			}
-			//レスポンス整形と返却
-			msg.CreatedAt = createdAt.Format(time.RFC3339)
-			msg.Deleted = deleted
-			messages = append(messages, msg)
+		if err := applyReadCounts(r.Context(), db, roomID, page.Messages); err != nil {
+			log.Println("既読数取得失敗:", err)
+			http.Error(w, "メッセージ取得に失敗しました", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(messages)
+		json.NewEncoder(w).Encode(page)
 	}
 }
 
+// before / after / limit のページングパラメータ
+type pageParams struct {
+	Limit  int
+	Before int
+	After  int
+}
+
+func parsePageParams(r *http.Request) (pageParams, error) {
+	q := r.URL.Query()
+	p := pageParams{Limit: defaultMessagePageSize}
+	var err error
+
+	if v := q.Get("limit"); v != "" {
+		p.Limit, err = strconv.Atoi(v)
+		if err != nil || p.Limit < 1 {
+			return p, errors.New("limitパラメータが無効です")
+		}
+		if p.Limit > maxMessagePageSize {
+			p.Limit = maxMessagePageSize
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		p.Before, err = strconv.Atoi(v)
+		if err != nil || p.Before < 1 {
+			return p, errors.New("beforeパラメータが無効です")
+		}
+	}
+	if v := q.Get("after"); v != "" {
+		p.After, err = strconv.Atoi(v)
+		if err != nil || p.After < 1 {
+			return p, errors.New("afterパラメータが無効です")
+		}
+	}
+	if p.Before != 0 && p.After != 0 {
+		return p, errors.New("beforeとafterは同時に指定できません")
+	}
+	return p, nil
+}
+
+// where（$1 に scopeID を取る条件）に合うメッセージを id のキーセットで1ページ分取得する
+func queryMessagePage(ctx context.Context, db *pgxpool.Pool, where string, scopeID int, p pageParams) (MessagePage, error) {
+	//続きがあるか判定するため1件多く取る
+	//after は古い順、それ以外は新しい順にインデックスをたどる
+	cond, order, cursor := "m.id < $2", "DESC", p.Before
+	if p.After != 0 {
+		cond, order, cursor = "m.id > $2", "ASC", p.After
+	} else if p.Before == 0 {
+		cursor = math.MaxInt32
+	}
+
+	rows, err := db.Query(ctx,
+		messageSelect+`
+		 WHERE `+where+` AND `+cond+`
+		 ORDER BY m.id `+order+`
+		 LIMIT $3`, scopeID, cursor, p.Limit+1,
+	)
+	if err != nil {
+		return MessagePage{}, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			log.Println("行スキャン失敗:", err)
+			continue
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return MessagePage{}, err
+	}
+
+	page := MessagePage{Messages: messages}
+	if len(messages) > p.Limit {
+		page.Messages = messages[:p.Limit]
+		next := page.Messages[p.Limit-1].ID
+		page.NextCursor = &next
+	}
+	if p.After == 0 {
+		//新しい順に取ったので古い順に並べ直す
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+	if page.Messages == nil {
+		page.Messages = []Message{}
+	}
+	return page, nil
+}
+
 // メッセージの送信ハンドラー
-func SendMessageHandler(db *pgxpool.Pool) http.HandlerFunc {
+func SendMessageHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		//JWT認証
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			log.Println("JWT検証失敗:", err)
 			http.Error(w, "認証エラー", http.StatusUnauthorized)
@@ -118,12 +375,39 @@ func SendMessageHandler(db *pgxpool.Pool) http.HandlerFunc {
 			return
 		}
 
-		_, err = db.Exec(
-			context.Background(),
-			//メッセージ挿入
-			"INSERT INTO messages (room_id, sender_id, text, created_at) VALUES ($1, $2, $3, $4)",
-			req.RoomID, senderID, req.Text, time.Now(),
-		)
+		//メンバー確認
+		if !authz.Require(w, r, req.RoomID, senderID) {
+			return
+		}
+
+		attachments, err := normalizeAttachments(r.Context(), db, senderID, req.Attachments, "")
+		if errors.Is(err, errInvalidAttachment) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("添付確認失敗:", err)
+			http.Error(w, "送信失敗", http.StatusInternalServerError)
+			return
+		}
+
+		//メッセージと添付の挿入
+		created, err := sendMessage(r.Context(), db, hub, newMessage{
+			RoomID:      req.RoomID,
+			SenderID:    senderID,
+			Text:        req.Text,
+			Attachments: attachments,
+			StampID:     req.StampID,
+			ParentID:    req.ParentMessageID,
+		}, username)
+		if errors.Is(err, errInvalidParent) || errors.Is(err, errInvalidStamp) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errRoomArchived) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		if err != nil {
 			log.Println("メッセージ挿入失敗:", err)
 			http.Error(w, "送信失敗", http.StatusInternalServerError)
@@ -131,83 +415,402 @@ func SendMessageHandler(db *pgxpool.Pool) http.HandlerFunc {
 		}
 
 		//レスポンスを返す
+		result := map[string]int{"message_id": created.ID}
+		if created.ParentID != 0 {
+			result["parent_message_id"] = created.ParentID
+		}
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
 	}
 }
 
-func PatchMessageHandler(db *pgxpool.Pool) http.HandlerFunc {
+// PATCH /messages/{id} の本文
+// text を送ると本文の編集、deleted: true を送ると論理削除
+type PatchMessageRequest struct {
+	Text    *string `json:"text"`
+	Deleted bool    `json:"deleted"`
+}
+
+// メッセージの編集履歴1件
+type MessageEdit struct {
+	Text     string `json:"text"`
+	EditedAt string `json:"edited_at"`
+	EditorID int    `json:"editor_id"`
+}
+
+func PatchMessageHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer, cfg config.MessagesConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		idStr := r.URL.Path[len("/messages/"):]
-		msgID, err := strconv.Atoi(idStr)
+		msgID, _, err := parseMessagePath(r.URL.Path)
 		if err != nil {
 			http.Error(w, "Invalid message ID", http.StatusBadRequest)
 			return
 		}
 
-		_, err = db.Exec(context.Background(),
-			`UPDATE messages SET deleted = true
-       WHERE id = $1 AND sender_id = (
-         SELECT id FROM users WHERE username = $2
-       )`,
-			msgID, username,
-		)
+		var req PatchMessageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if !req.Deleted {
+			if req.Text == nil {
+				http.Error(w, "text か deleted を指定してください", http.StatusBadRequest)
+				return
+			}
+			if strings.TrimSpace(*req.Text) == "" {
+				http.Error(w, "本文が空です", http.StatusBadRequest)
+				return
+			}
+		}
+
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
 
+		ctx := r.Context()
+		tx, err := db.Begin(ctx)
 		if err != nil {
-			log.Println("論理削除失敗:", err)
-			http.Error(w, "Failed to delete", http.StatusInternalServerError)
+			http.Error(w, "Failed to edit", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var senderID, roomID int
+		var oldText string
+		var createdAt time.Time
+		var deleted bool
+		err = tx.QueryRow(ctx,
+			`SELECT sender_id, room_id, text, created_at, deleted
+			 FROM messages WHERE id = $1 AND kind = 'user' FOR UPDATE`, msgID,
+		).Scan(&senderID, &roomID, &oldText, &createdAt, &deleted)
+		if err != nil {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		// 退出したルームのメッセージは送信者でも変更できない
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+		if senderID != userID {
+			http.Error(w, "送信者以外は編集できません", http.StatusForbidden)
+			return
+		}
+
+		if err := lockActiveRoom(ctx, tx, roomID); errors.Is(err, errRoomArchived) {
+			http.Error(w, "アーカイブされたルームのメッセージは変更できません", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println("ルーム取得失敗:", err)
+			http.Error(w, "Failed to edit", http.StatusInternalServerError)
+			return
+		}
+
+		if req.Deleted {
+			if deleted {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			if _, err := tx.Exec(ctx, `UPDATE messages SET deleted = true WHERE id = $1`, msgID); err != nil {
+				log.Println("論理削除失敗:", err)
+				http.Error(w, "Failed to delete", http.StatusInternalServerError)
+				return
+			}
+			if err := tx.Commit(ctx); err != nil {
+				log.Println("論理削除失敗:", err)
+				http.Error(w, "Failed to delete", http.StatusInternalServerError)
+				return
+			}
+
+			// 削除の通知はサーバーから流す（クライアントからの delete フレームは受け付けない）
+			hub.Broadcast(roomID, map[string]interface{}{
+				"type":        "delete",
+				"room_id":     roomID,
+				"message_id":  msgID,
+				"hard_delete": false,
+			})
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		newText := *req.Text
+		if deleted {
+			http.Error(w, "削除済みのメッセージは編集できません", http.StatusConflict)
+			return
+		}
+		if time.Since(createdAt) > cfg.EditWindow {
+			http.Error(w, "編集可能時間を過ぎています", http.StatusForbidden)
+			return
+		}
+		if newText == oldText {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		_, err = tx.Exec(ctx,
+			`INSERT INTO message_edits (message_id, editor_id, previous_text) VALUES ($1, $2, $3)`,
+			msgID, userID, oldText)
+		if err != nil {
+			log.Println("編集履歴保存失敗:", err)
+			http.Error(w, "Failed to edit", http.StatusInternalServerError)
+			return
+		}
+
+		var editedAt time.Time
+		err = tx.QueryRow(ctx,
+			`UPDATE messages SET text = $2, edited_at = now() WHERE id = $1 RETURNING edited_at`,
+			msgID, newText,
+		).Scan(&editedAt)
+		if err != nil {
+			log.Println("メッセージ編集失敗:", err)
+			http.Error(w, "Failed to edit", http.StatusInternalServerError)
+			return
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			log.Println("メッセージ編集失敗:", err)
+			http.Error(w, "Failed to edit", http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		// 新しい本文でメンションを取り直す（消えたメンションは削除し、増えた分だけ通知する）
+		_, err = db.Exec(ctx,
+			`DELETE FROM mentions m USING users u
+			 WHERE m.mention_target_id = u.id AND m.message_id = $1 AND u.username <> ALL($2)`,
+			msgID, mentionedUsernames(newText))
+		if err != nil {
+			log.Println("メンション削除失敗:", err)
+		}
+		mentioned := insertMentions(db, roomID, msgID, newText, username)
+
+		hub.Broadcast(roomID, map[string]interface{}{
+			"type":       "edit",
+			"room_id":    roomID,
+			"message_id": msgID,
+			"text":       newText,
+			"edited_at":  editedAt.Format(time.RFC3339),
+		})
+		notifyMentions(hub, mentioned, WSMessage{RoomID: roomID, MessageID: msgID, Text: newText, Username: username})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message_id": msgID,
+			"text":       newText,
+			"edited_at":  editedAt.Format(time.RFC3339),
+		})
 	}
 }
 
-func DeleteMessageHandler(db *pgxpool.Pool) http.HandlerFunc {
+// GET /messages/{id}/history
+func MessageHistoryHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		idStr := r.URL.Path[len("/messages/"):]
-		msgID, err := strconv.Atoi(idStr)
+		msgID, _, err := parseMessagePath(r.URL.Path)
 		if err != nil {
 			http.Error(w, "Invalid message ID", http.StatusBadRequest)
 			return
 		}
 
-		var createdAt time.Time
-		err = db.QueryRow(context.Background(),
-			`SELECT m.created_at
-       FROM messages m JOIN users u ON m.sender_id = u.id
-       WHERE m.id = $1 AND u.username = $2`,
-			msgID, username,
-		).Scan(&createdAt)
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
 
+		var roomID int
+		var text string
+		var editedAt *time.Time
+		err = db.QueryRow(r.Context(),
+			`SELECT room_id, text, edited_at FROM messages WHERE id = $1`, msgID,
+		).Scan(&roomID, &text, &editedAt)
 		if err != nil {
 			http.Error(w, "Message not found", http.StatusNotFound)
 			return
 		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+
+		rows, err := db.Query(r.Context(),
+			`SELECT previous_text, edited_at, editor_id
+			 FROM message_edits WHERE message_id = $1
+			 ORDER BY edited_at ASC, id ASC`, msgID)
+		if err != nil {
+			log.Println("編集履歴取得失敗:", err)
+			http.Error(w, "Failed to get history", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		edits := []MessageEdit{}
+		for rows.Next() {
+			var e MessageEdit
+			var at time.Time
+			if err := rows.Scan(&e.Text, &at, &e.EditorID); err != nil {
+				log.Println("行スキャン失敗:", err)
+				continue
+			}
+			e.EditedAt = at.Format(time.RFC3339)
+			edits = append(edits, e)
+		}
+
+		result := map[string]interface{}{
+			"message_id": msgID,
+			"text":       text,
+			"edits":      edits, // 古い順。各要素はその時点より前の本文
+		}
+		if editedAt != nil {
+			result["edited_at"] = editedAt.Format(time.RFC3339)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func DeleteMessageHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		msgID, _, err := parseMessagePath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := r.Context()
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			http.Error(w, "Failed to delete", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var senderID, roomID int
+		var createdAt time.Time
+		err = tx.QueryRow(ctx,
+			`SELECT sender_id, room_id, created_at
+			 FROM messages WHERE id = $1 AND kind = 'user' FOR UPDATE`, msgID,
+		).Scan(&senderID, &roomID, &createdAt)
+		if err != nil {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		// 退出したルームのメッセージは送信者でも取り消せない
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+		if senderID != userID {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
 
 		if time.Since(createdAt) > 60*time.Second {
 			http.Error(w, "取り消し時間超過", http.StatusForbidden)
 			return
 		}
 
-		_, err = db.Exec(context.Background(), `DELETE FROM messages WHERE id = $1`, msgID)
+		if err := lockActiveRoom(ctx, tx, roomID); errors.Is(err, errRoomArchived) {
+			http.Error(w, "アーカイブされたルームのメッセージは変更できません", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println("ルーム取得失敗:", err)
+			http.Error(w, "Failed to delete", http.StatusInternalServerError)
+			return
+		}
+
+		// 他人の返信が付いたスレッドの先頭は、返信ごと消さずに論理削除にとどめる
+		var hasReplies bool
+		err = tx.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM messages WHERE parent_message_id = $1)`, msgID,
+		).Scan(&hasReplies)
+		if err == nil {
+			if hasReplies {
+				_, err = tx.Exec(ctx, `UPDATE messages SET deleted = true WHERE id = $1`, msgID)
+			} else {
+				_, err = tx.Exec(ctx, `DELETE FROM messages WHERE id = $1`, msgID)
+			}
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
 		if err != nil {
 			log.Println("物理削除失敗:", err)
 			http.Error(w, "Failed to delete", http.StatusInternalServerError)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
+		hub.Broadcast(roomID, map[string]interface{}{
+			"type":        "delete",
+			"room_id":     roomID,
+			"message_id":  msgID,
+			"hard_delete": !hasReplies,
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message_id":  msgID,
+			"hard_delete": !hasReplies,
+		})
+	}
+}
+
+// /messages/{id} 配下をメソッドとサブパスで振り分ける統合ハンドラー
+func MessageResourceHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer, cfg config.MessagesConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, sub, err := parseMessagePath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case sub == "" && r.Method == http.MethodPatch:
+			PatchMessageHandler(db, tokens, hub, authz, cfg)(w, r)
+		case sub == "" && r.Method == http.MethodDelete:
+			DeleteMessageHandler(db, tokens, hub, authz)(w, r)
+		case sub == "history" && r.Method == http.MethodGet:
+			MessageHistoryHandler(db, tokens, authz)(w, r)
+		case sub == "thread" && r.Method == http.MethodGet:
+			ThreadHandler(db, tokens, authz)(w, r)
+		case sub == "thread/read" && r.Method == http.MethodPost:
+			MarkThreadAsReadHandler(db, tokens, hub, authz)(w, r)
+		case sub == "readers" && r.Method == http.MethodGet:
+			MessageReadersHandler(db, tokens, authz)(w, r)
+		case sub == "reactions" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+			ReactionsHandler(db, tokens, hub, authz)(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
 	}
 }
+
+// /messages/{id} または /messages/{id}/{sub} を分解する
+func parseMessagePath(path string) (int, string, error) {
+	rest := strings.TrimPrefix(path, "/messages/")
+	idStr, sub, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(idStr)
+	return id, sub, err
+}
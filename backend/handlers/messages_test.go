@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"backend/config"
+)
+
+// 編集・論理削除・送信取り消しは、アーカイブ中のルームでは 409、退出後は 403
+func TestMessageChangesRequireMembershipAndActiveRoom(t *testing.T) {
+	e := newTestEnv(t)
+	alice, _ := e.user(t, "alice")
+	bob, bobToken := e.user(t, "bob")
+	roomID := e.group(t, "edits", alice, bob)
+	msgID := e.message(t, roomID, bob, "before")
+	h := MessageResourceHandler(e.db, e.tokens, e.hub, e.authz, config.Default().Messages)
+	target := fmt.Sprintf("/messages/%d", msgID)
+	ctx := context.Background()
+
+	text := "after"
+	requests := []struct {
+		name, method string
+		body         interface{}
+	}{
+		{"編集", http.MethodPatch, PatchMessageRequest{Text: &text}},
+		{"論理削除", http.MethodPatch, PatchMessageRequest{Deleted: true}},
+		{"送信取り消し", http.MethodDelete, nil},
+	}
+	check := func(want int) {
+		t.Helper()
+		for _, req := range requests {
+			if rec := serve(t, h, req.method, target, bobToken, req.body); rec.Code != want {
+				t.Errorf("%s: status = %d, want %d", req.name, rec.Code, want)
+			}
+		}
+	}
+
+	if _, err := e.db.Exec(ctx, `UPDATE chat_rooms SET archived_at = now() WHERE id = $1`, roomID); err != nil {
+		t.Fatal(err)
+	}
+	check(http.StatusConflict)
+
+	if _, err := e.db.Exec(ctx, `UPDATE chat_rooms SET archived_at = NULL WHERE id = $1`, roomID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.db.Exec(ctx, `DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`, roomID, bob); err != nil {
+		t.Fatal(err)
+	}
+	e.authz.Invalidate(bob, roomID)
+	check(http.StatusForbidden)
+
+	var got string
+	var deleted bool
+	if err := e.db.QueryRow(ctx, `SELECT text, deleted FROM messages WHERE id = $1`, msgID).Scan(&got, &deleted); err != nil {
+		t.Fatal(err)
+	}
+	if got != "before" || deleted {
+		t.Errorf("text = %q・deleted = %v, want 変更なし", got, deleted)
+	}
+}
+
+// 返信の付いたスレッドの先頭を取り消しても他人の返信は消さず、先頭は削除済みとして残る
+func TestDeleteThreadRootKeepsReplies(t *testing.T) {
+	e := newTestEnv(t)
+	alice, aliceToken := e.user(t, "alice")
+	bob, _ := e.user(t, "bob")
+	roomID := e.group(t, "threads", alice, bob)
+	rootID := e.message(t, roomID, alice, "root")
+	ctx := context.Background()
+	if _, err := e.db.Exec(ctx,
+		`INSERT INTO messages (room_id, sender_id, text, parent_message_id) VALUES ($1, $2, 'reply', $3)`,
+		roomID, bob, rootID); err != nil {
+		t.Fatal(err)
+	}
+
+	h := DeleteMessageHandler(e.db, e.tokens, e.hub, e.authz)
+	if rec := serve(t, h, http.MethodDelete, fmt.Sprintf("/messages/%d", rootID), aliceToken, nil); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+
+	var deleted bool
+	var replies int
+	err := e.db.QueryRow(ctx,
+		`SELECT deleted, (SELECT COUNT(*) FROM messages WHERE parent_message_id = $1) FROM messages WHERE id = $1`,
+		rootID).Scan(&deleted, &replies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted || replies != 1 {
+		t.Errorf("deleted = %v・返信 %d 件, want true・1 件", deleted, replies)
+	}
+}
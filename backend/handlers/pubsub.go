@@ -0,0 +1,109 @@
+// インスタンス間のイベント中継
+// ハブが配信したイベントを Redis の pub/sub に流し、他インスタンスのハブでも配信する
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+)
+
+const (
+	roomChannelPrefix = "chat:room:" // ルーム宛てイベント
+	userChannelPrefix = "chat:user:" // ユーザー宛てイベントとルーム参加・退出
+)
+
+// Redis に流す封筒。Instance が自分と同じものは自分が送ったものなので無視する
+type busEnvelope struct {
+	Instance  string          `json:"instance"`
+	Kind      string          `json:"kind"` // "event", "membership" or "revoke"
+	RoomID    int             `json:"room_id,omitempty"`
+	UserID    int             `json:"user_id,omitempty"`
+	Focused   bool            `json:"focused,omitempty"`
+	Joined    bool            `json:"joined,omitempty"`
+	SessionID string          `json:"session_id,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+func eventChannel(ev hubEvent) string {
+	if ev.userID != 0 {
+		return userChannelPrefix + strconv.Itoa(ev.userID)
+	}
+	return roomChannelPrefix + strconv.Itoa(ev.roomID)
+}
+
+func (h *Hub) publishEvent(ev hubEvent) {
+	h.publish(eventChannel(ev), busEnvelope{
+		Kind:    "event",
+		RoomID:  ev.roomID,
+		UserID:  ev.userID,
+		Focused: ev.focused,
+		Payload: ev.payload,
+	})
+}
+
+func (h *Hub) publishMembership(m membership) {
+	h.publish(userChannelPrefix+strconv.Itoa(m.userID), busEnvelope{
+		Kind:   "membership",
+		RoomID: m.roomID,
+		UserID: m.userID,
+		Joined: m.joined,
+	})
+}
+
+func (h *Hub) publishRevocation(rv revocation) {
+	h.publish(userChannelPrefix+strconv.Itoa(rv.userID), busEnvelope{
+		Kind:      "revoke",
+		UserID:    rv.userID,
+		SessionID: rv.sessionID,
+	})
+}
+
+func (h *Hub) publish(channel string, env busEnvelope) {
+	if h.rdb == nil {
+		return
+	}
+	env.Instance = h.instanceID
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Println("pub/sub エンコード失敗:", err)
+		return
+	}
+	if err := h.rdb.Publish(context.Background(), channel, data).Err(); err != nil {
+		log.Println("pub/sub 送信失敗:", err)
+	}
+}
+
+// 他インスタンスからのイベントを受け取り、このインスタンスの接続に配信する
+func (h *Hub) listen(ctx context.Context) {
+	ps := h.rdb.PSubscribe(ctx, roomChannelPrefix+"*", userChannelPrefix+"*")
+	defer ps.Close()
+
+	for msg := range ps.Channel() {
+		var env busEnvelope
+		if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+			log.Println("pub/sub デコード失敗:", msg.Channel, err)
+			continue
+		}
+		if env.Instance == h.instanceID {
+			continue
+		}
+
+		switch env.Kind {
+		case "event":
+			h.broadcast <- hubEvent{
+				roomID:  env.RoomID,
+				userID:  env.UserID,
+				focused: env.Focused,
+				payload: env.Payload,
+			}
+		case "membership":
+			h.members <- membership{userID: env.UserID, roomID: env.RoomID, joined: env.Joined}
+		case "revoke":
+			h.revocations <- revocation{userID: env.UserID, sessionID: env.SessionID}
+		default:
+			log.Println("pub/sub 不明なイベント:", msg.Channel, env.Kind)
+		}
+	}
+}
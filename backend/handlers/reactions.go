@@ -0,0 +1,208 @@
+// 絵文字リアクション
+package handlers
+
+import (
+	"backend/utils"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const maxEmojiBytes = 64
+
+// メッセージごとの集計
+type ReactionSummary struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"` // 付けた順
+}
+
+// メッセージ1件分のリアクション集計をJSON配列で返すSQL断片（m は messages の別名）
+const reactionsJSONColumn = `COALESCE((
+	SELECT json_agg(json_build_object('emoji', x.emoji, 'count', x.cnt, 'users', x.users) ORDER BY x.first_at)
+	FROM (
+		SELECT mr.emoji, COUNT(*) AS cnt,
+		       array_agg(ru.username ORDER BY mr.created_at) AS users,
+		       MIN(mr.created_at) AS first_at
+		FROM message_reactions mr
+		JOIN users ru ON ru.id = mr.user_id
+		WHERE mr.message_id = m.id
+		GROUP BY mr.emoji
+	) x
+), '[]'::json)`
+
+const (
+	zwj    = '\u200d' // 絵文字どうしをつなぐ（👨‍👩‍👧 など）
+	vs16   = '\ufe0f' // 絵文字として表示する異体字セレクタ
+	keycap = '\u20e3' // 1️⃣ などのキーキャップ
+)
+
+// 絵文字1つ分として妥当か
+// 記号（\p{So}）1つに異体字セレクタ・肌の色・タグが付いたもの、それを ZWJ でつないだもの、
+// キーキャップ、地域指示子2つの国旗だけを通す。ただの文字列や HTML はリアクションにしない
+func validEmoji(emoji string) bool {
+	if emoji == "" || len(emoji) > maxEmojiBytes || !utf8.ValidString(emoji) {
+		return false
+	}
+	rs := []rune(emoji)
+	switch {
+	case strings.ContainsRune("0123456789#*", rs[0]):
+		return len(rs) == 2 && rs[1] == keycap || len(rs) == 3 && rs[1] == vs16 && rs[2] == keycap
+	case isRegionalIndicator(rs[0]):
+		return len(rs) == 2 && isRegionalIndicator(rs[1])
+	}
+
+	needBase := true
+	for _, r := range rs {
+		switch {
+		case needBase:
+			if !unicode.Is(unicode.So, r) || isRegionalIndicator(r) {
+				return false
+			}
+			needBase = false
+		case r == zwj:
+			needBase = true
+		case r == vs16 || isSkinTone(r) || isEmojiTag(r):
+		default:
+			return false
+		}
+	}
+	return !needBase
+}
+
+func isRegionalIndicator(r rune) bool { return r >= 0x1f1e6 && r <= 0x1f1ff }
+func isSkinTone(r rune) bool          { return r >= 0x1f3fb && r <= 0x1f3ff }
+func isEmojiTag(r rune) bool          { return r >= 0xe0020 && r <= 0xe007f } // イングランドなど地域の旗
+
+// POST   /messages/{id}/reactions  {"emoji": "👍"}
+// DELETE /messages/{id}/reactions?emoji=👍
+func ReactionsHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		msgID, _, err := parseMessagePath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+
+		emoji := r.URL.Query().Get("emoji")
+		if emoji == "" && r.ContentLength != 0 {
+			var req struct {
+				Emoji string `json:"emoji"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			emoji = req.Emoji
+		}
+		if !validEmoji(emoji) {
+			http.Error(w, "emoji が不正です", http.StatusBadRequest)
+			return
+		}
+
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := r.Context()
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			http.Error(w, "Failed to update reaction", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var roomID int
+		var deleted bool
+		err = tx.QueryRow(ctx,
+			`SELECT room_id, deleted FROM messages WHERE id = $1`, msgID,
+		).Scan(&roomID, &deleted)
+		if err != nil {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+		if err := lockActiveRoom(ctx, tx, roomID); errors.Is(err, errRoomArchived) {
+			http.Error(w, "アーカイブされたルームではリアクションできません", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Println("ルーム取得失敗:", err)
+			http.Error(w, "Failed to update reaction", http.StatusInternalServerError)
+			return
+		}
+
+		event := map[string]interface{}{
+			"room_id":    roomID,
+			"message_id": msgID,
+			"emoji":      emoji,
+			"user_id":    userID,
+			"username":   username,
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			if deleted {
+				http.Error(w, "削除済みのメッセージにはリアクションできません", http.StatusConflict)
+				return
+			}
+			tag, err := tx.Exec(ctx,
+				`INSERT INTO message_reactions (message_id, user_id, emoji)
+				 VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+				msgID, userID, emoji)
+			if err == nil {
+				err = tx.Commit(ctx)
+			}
+			if err != nil {
+				log.Println("リアクション保存失敗:", err)
+				http.Error(w, "Failed to add reaction", http.StatusInternalServerError)
+				return
+			}
+			if tag.RowsAffected() == 0 {
+				w.WriteHeader(http.StatusOK) // 既に付いている
+				return
+			}
+			event["type"] = "reaction_added"
+			hub.Broadcast(roomID, event)
+			w.WriteHeader(http.StatusCreated)
+
+		case http.MethodDelete:
+			tag, err := tx.Exec(ctx,
+				`DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3`,
+				msgID, userID, emoji)
+			if err == nil {
+				err = tx.Commit(ctx)
+			}
+			if err != nil {
+				log.Println("リアクション削除失敗:", err)
+				http.Error(w, "Failed to remove reaction", http.StatusInternalServerError)
+				return
+			}
+			if tag.RowsAffected() == 0 {
+				http.Error(w, "Reaction not found", http.StatusNotFound)
+				return
+			}
+			event["type"] = "reaction_removed"
+			hub.Broadcast(roomID, event)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
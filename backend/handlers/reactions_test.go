@@ -0,0 +1,40 @@
+package handlers
+
+import "testing"
+
+func TestValidEmoji(t *testing.T) {
+	valid := []string{
+		"👍",
+		"❤️",
+		"👍🏽",
+		"👨‍👩‍👧",
+		"🏳️‍🌈",
+		"1️⃣",
+		"🇯🇵",
+		"\U0001F3F4\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F", // イングランドの旗
+	}
+	for _, e := range valid {
+		if !validEmoji(e) {
+			t.Errorf("validEmoji(%q) = false, want true", e)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"lol",
+		"<script>",
+		"👍 ",
+		"👍👎",
+		"👍a",
+		"‍👍",
+		"👍‍",
+		"🇯",
+		"1",
+		"️",
+	}
+	for _, e := range invalid {
+		if validEmoji(e) {
+			t.Errorf("validEmoji(%q) = true, want false", e)
+		}
+	}
+}
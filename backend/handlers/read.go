@@ -1,21 +1,106 @@
 // handlers/read.go
+// 既読はメンバーごとのカーソル（room_members.last_read_message_id）で持つ
+// カーソル以下のメッセージはすべて既読として扱い、カーソルは進むだけで戻らない
 package handlers
 
 import (
 	"backend/utils"
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func MarkAsReadHandler(db *pgxpool.Pool) http.HandlerFunc {
+// 既読の数（送信者を除くメンバーのうち何人が読んだか）
+type ReadSummary struct {
+	Count int `json:"count"`
+	Total int `json:"total"`
+}
+
+// userID のカーソルを messageID まで進める。すでにそれ以上読んでいれば false
+func advanceReadCursor(ctx context.Context, db *pgxpool.Pool, roomID, userID, messageID int) (bool, error) {
+	tag, err := db.Exec(ctx, `
+		UPDATE room_members SET last_read_message_id = $3, last_read_at = now()
+		WHERE room_id = $1 AND user_id = $2
+		  AND COALESCE(last_read_message_id, 0) < $3
+		  AND EXISTS (SELECT 1 FROM messages WHERE id = $3 AND room_id = $1)`,
+		roomID, userID, messageID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// 既読の通知。message_id は読んだ人のカーソルで、それ以下がすべて既読になったことを表す
+func broadcastRead(hub *Hub, roomID, userID int, username string, messageID int) {
+	hub.BroadcastFocused(roomID, map[string]interface{}{
+		"type":       "read",
+		"room_id":    roomID,
+		"user_id":    userID,
+		"username":   username,
+		"message_id": messageID,
+	})
+}
+
+// ルームのメンバー全員のカーソル（未読のメンバーは 0）
+func roomReadCursors(ctx context.Context, db *pgxpool.Pool, roomID int) (map[int]int, error) {
+	rows, err := db.Query(ctx,
+		`SELECT user_id, COALESCE(last_read_message_id, 0) FROM room_members WHERE room_id = $1`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cursors := make(map[int]int)
+	for rows.Next() {
+		var userID, cursor int
+		if err := rows.Scan(&userID, &cursor); err != nil {
+			return nil, err
+		}
+		cursors[userID] = cursor
+	}
+	return cursors, rows.Err()
+}
+
+// 各メッセージに「M人中N人が既読」を付ける（システムメッセージは除く）
+func applyReadCounts(ctx context.Context, db *pgxpool.Pool, roomID int, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	cursors, err := roomReadCursors(ctx, db, roomID)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		m := &messages[i]
+		if m.Kind == messageKindSystem {
+			continue
+		}
+		reads := ReadSummary{}
+		for userID, cursor := range cursors {
+			if userID == m.SenderID {
+				continue
+			}
+			reads.Total++
+			if cursor >= m.ID {
+				reads.Count++
+			}
+		}
+		m.Reads = &reads
+	}
+	return nil
+}
+
+// POST /read {"message_id": …} そのメッセージまでを既読にする
+func MarkAsReadHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// JWT から username を取得
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -31,56 +116,45 @@ func MarkAsReadHandler(db *pgxpool.Pool) http.HandlerFunc {
 		}
 
 		// ユーザーIDを取得
-		var userID int
-		err = db.QueryRow(context.Background(),
-			"SELECT id FROM users WHERE username = $1", username,
-		).Scan(&userID)
+		userID, err := userIDByName(r.Context(), db, username)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
 
-		// message_reads に登録（すでに既読なら無視）
-		_, err = db.Exec(context.Background(),
-			`INSERT INTO message_reads (message_id, user_id)
-			 VALUES ($1, $2)
-			 ON CONFLICT DO NOTHING`,
-			req.MessageID, userID,
-		)
+		// メッセージのルームIDを取得してメンバー確認
+		var roomID int
+		err = db.QueryRow(r.Context(), `SELECT room_id FROM messages WHERE id = $1`, req.MessageID).Scan(&roomID)
 		if err != nil {
-			http.Error(w, "Failed to insert", http.StatusInternalServerError)
+			log.Println("ルームID取得失敗:", err)
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
 			return
 		}
 
-		// メッセージのルームIDを取得
-		var roomID int
-		err = db.QueryRow(context.Background(), `SELECT room_id FROM messages WHERE id = $1`, req.MessageID).Scan(&roomID)
+		// カーソルを進める（すでに先まで読んでいれば何もしない）
+		advanced, err := advanceReadCursor(r.Context(), db, roomID, userID, req.MessageID)
 		if err != nil {
-			log.Println("ルームID取得失敗:", err)
-			w.WriteHeader(http.StatusOK)
+			log.Println("既読カーソル更新失敗:", err)
+			http.Error(w, "Failed to mark as read", http.StatusInternalServerError)
 			return
 		}
 
 		// WebSocketで通知
-		RoomClientsMutex.Lock()
-		for _, c := range RoomClients[roomID] {
-			_ = c.Conn.WriteJSON(map[string]interface{}{
-				"type":       "read",
-				"room_id":    roomID,
-				"username":   username,
-				"message_id": req.MessageID,
-			})
+		if advanced {
+			broadcastRead(hub, roomID, userID, username, req.MessageID)
 		}
-		RoomClientsMutex.Unlock()
 
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
-// 既読状態取得
-func GetReadStatusHandler(db *pgxpool.Pool) http.HandlerFunc {
+// 既読状態取得（自分が送信したメッセージのうち、誰かが読んだもののID）
+func GetReadStatusHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -93,27 +167,36 @@ func GetReadStatusHandler(db *pgxpool.Pool) http.HandlerFunc {
 			return
 		}
 
-		// 自分が送信したメッセージIDのうち、既読がついているもの
-		rows, err := db.Query(context.Background(), `
-			SELECT mr.message_id
-			FROM message_reads mr
-			JOIN messages m ON mr.message_id = m.id
-			JOIN users u ON u.username = $1
-			WHERE m.sender_id = u.id AND m.room_id = $2
-		`, username, roomID)
+		userID, err := userIDByName(r.Context(), db, username)
 		if err != nil {
-			log.Printf("message_reads挿入失敗: %v", err)
-			http.Error(w, "Failed to get read status", http.StatusInternalServerError)
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
 			return
 		}
-		defer rows.Close()
 
-		var ids []int
-		for rows.Next() {
-			var id int
-			if err := rows.Scan(&id); err == nil {
-				ids = append(ids, id)
-			}
+		// 他のメンバーで一番先まで読んでいる人のカーソル以下が「既読あり」
+		rows, err := db.Query(r.Context(), `
+			SELECT m.id
+			FROM messages m
+			WHERE m.sender_id = $1 AND m.room_id = $2
+			  AND m.id <= (
+			    SELECT COALESCE(MAX(last_read_message_id), 0) FROM room_members
+			    WHERE room_id = $2 AND user_id <> $1
+			  )
+			ORDER BY m.id
+		`, userID, roomID)
+		if err != nil {
+			log.Printf("既読状態取得失敗: %v", err)
+			http.Error(w, "Failed to get read status", http.StatusInternalServerError)
+			return
+		}
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			log.Printf("既読状態取得失敗: %v", err)
+			http.Error(w, "Failed to get read status", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -121,9 +204,16 @@ func GetReadStatusHandler(db *pgxpool.Pool) http.HandlerFunc {
 	}
 }
 
-// 全メッセージの既読ユーザーを取得
-func GetFullReadStatusHandler(db *pgxpool.Pool) http.HandlerFunc {
+// 直近のメッセージごとの既読ユーザー（古いクライアント向け）
+// 件数は GET /messages の reads、誰が読んだかは GET /messages/{id}/readers を使う
+func GetFullReadStatusHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		roomIDStr := r.URL.Query().Get("room")
 		roomID, err := strconv.Atoi(roomIDStr)
 		if err != nil {
@@ -131,13 +221,28 @@ func GetFullReadStatusHandler(db *pgxpool.Pool) http.HandlerFunc {
 			return
 		}
 
-		rows, err := db.Query(context.Background(), `
-			SELECT mr.message_id, u.username
-			FROM message_reads mr
-			JOIN users u ON mr.user_id = u.id
-			JOIN messages m ON mr.message_id = m.id
-			WHERE m.room_id = $1
-		`, roomID)
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+
+		// 直近 maxMessagePageSize 件だけをカーソルと突き合わせる
+		rows, err := db.Query(r.Context(), `
+			SELECT m.id, u.username
+			FROM (
+				SELECT id, sender_id FROM messages
+				WHERE room_id = $1 AND kind = 'user'
+				ORDER BY id DESC
+				LIMIT $2
+			) m
+			JOIN room_members rm ON rm.room_id = $1 AND rm.user_id <> m.sender_id AND rm.last_read_message_id >= m.id
+			JOIN users u ON u.id = rm.user_id
+			ORDER BY m.id, u.username
+		`, roomID, maxMessagePageSize)
 		if err != nil {
 			log.Printf("read_status_full取得失敗: %v", err)
 			http.Error(w, "Failed to fetch", http.StatusInternalServerError)
@@ -159,9 +264,93 @@ func GetFullReadStatusHandler(db *pgxpool.Pool) http.HandlerFunc {
 	}
 }
 
-func GetUnreadCountHandler(db *pgxpool.Pool) http.HandlerFunc {
+// メッセージを読んだ人・まだ読んでいない人（送信者を除くメンバー）
+type MessageReaders struct {
+	MessageID int          `json:"message_id"`
+	Read      []RoomMember `json:"read"`
+	Unread    []RoomMember `json:"unread"`
+}
+
+// GET /messages/{id}/readers
+func MessageReadersHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		msgID, _, err := parseMessagePath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		var roomID, senderID int
+		err = db.QueryRow(r.Context(),
+			`SELECT room_id, sender_id FROM messages WHERE id = $1`, msgID,
+		).Scan(&roomID, &senderID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Println("メッセージ取得失敗:", err)
+			http.Error(w, "Failed to get readers", http.StatusInternalServerError)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+
+		rows, err := db.Query(r.Context(), `
+			SELECT u.id, u.username, rm.role, COALESCE(rm.last_read_message_id, 0)
+			FROM room_members rm
+			JOIN users u ON u.id = rm.user_id
+			WHERE rm.room_id = $1 AND rm.user_id <> $2
+			ORDER BY rm.last_read_at NULLS LAST, u.username
+		`, roomID, senderID)
+		if err != nil {
+			log.Println("既読ユーザー取得失敗:", err)
+			http.Error(w, "Failed to get readers", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		res := MessageReaders{MessageID: msgID, Read: []RoomMember{}, Unread: []RoomMember{}}
+		for rows.Next() {
+			var m RoomMember
+			var cursor int
+			if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &cursor); err != nil {
+				log.Println("既読ユーザー取得失敗:", err)
+				http.Error(w, "Failed to get readers", http.StatusInternalServerError)
+				return
+			}
+			m.LastReadMessageID = &cursor
+			if cursor >= msgID {
+				res.Read = append(res.Read, m)
+			} else {
+				res.Unread = append(res.Unread, m)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("既読ユーザー取得失敗:", err)
+			http.Error(w, "Failed to get readers", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func GetUnreadCountHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -174,26 +363,26 @@ func GetUnreadCountHandler(db *pgxpool.Pool) http.HandlerFunc {
 			return
 		}
 
-		var userID int
-		err = db.QueryRow(context.Background(),
-			"SELECT id FROM users WHERE username = $1", username,
-		).Scan(&userID)
+		userID, err := userIDByName(r.Context(), db, username)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
 
 		// 未読件数の集計クエリ
 		var count int
-		err = db.QueryRow(context.Background(), `
+		err = db.QueryRow(r.Context(), `
 			SELECT COUNT(*)
 			FROM messages m
+			JOIN room_members rm ON rm.room_id = m.room_id AND rm.user_id = $2
 			WHERE m.room_id = $1
 			  AND m.sender_id != $2
-			  AND NOT EXISTS (
-			    SELECT 1 FROM message_reads mr
-			    WHERE mr.message_id = m.id AND mr.user_id = $2
-			  )
+			  AND m.parent_message_id IS NULL -- スレッド返信は /thread_unread で数える
+			  AND NOT m.deleted
+			  AND m.id > COALESCE(rm.last_read_message_id, 0)
 		`, roomID, userID).Scan(&count)
 		if err != nil {
 			http.Error(w, "Failed to count unread", http.StatusInternalServerError)
@@ -205,9 +394,10 @@ func GetUnreadCountHandler(db *pgxpool.Pool) http.HandlerFunc {
 	}
 }
 
-func MarkAllAsReadHandler(db *pgxpool.Pool) http.HandlerFunc {
+// ルームの最新メッセージまでを既読にする
+func MarkAllAsReadHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -220,33 +410,202 @@ func MarkAllAsReadHandler(db *pgxpool.Pool) http.HandlerFunc {
 			return
 		}
 
-		var userID int
-		err = db.QueryRow(context.Background(),
-			"SELECT id FROM users WHERE username = $1", username,
-		).Scan(&userID)
+		userID, err := userIDByName(r.Context(), db, username)
 		if err != nil {
 			http.Error(w, "User not found", http.StatusNotFound)
 			return
 		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
 
-		// まだ既読になっていないメッセージを一括登録
-		_, err = db.Exec(context.Background(), `
-      INSERT INTO message_reads (message_id, user_id)
-      SELECT m.id, $1
-      FROM messages m
-      WHERE m.room_id = $2
-        AND m.sender_id != $1
-        AND NOT EXISTS (
-          SELECT 1 FROM message_reads mr
-          WHERE mr.message_id = m.id AND mr.user_id = $1
-        )
-    `, userID, roomID)
+		var latest *int
+		err = db.QueryRow(r.Context(), `SELECT MAX(id) FROM messages WHERE room_id = $1`, roomID).Scan(&latest)
+		if err != nil {
+			http.Error(w, "Failed to mark all as read", http.StatusInternalServerError)
+			return
+		}
+		if latest == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 
+		advanced, err := advanceReadCursor(r.Context(), db, roomID, userID, *latest)
 		if err != nil {
+			log.Println("既読カーソル更新失敗:", err)
 			http.Error(w, "Failed to mark all as read", http.StatusInternalServerError)
 			return
 		}
+		if advanced {
+			broadcastRead(hub, roomID, userID, username, *latest)
+		}
 
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+// スレッドの未読返信数（自分の返信は数えない）
+func threadUnreadCount(ctx context.Context, db *pgxpool.Pool, userID, rootID int) (int, error) {
+	var count int
+	err := db.QueryRow(ctx, `
+		SELECT COUNT(*)
+		FROM messages r
+		LEFT JOIN thread_reads tr ON tr.root_message_id = r.parent_message_id AND tr.user_id = $1
+		WHERE r.parent_message_id = $2
+		  AND r.sender_id != $1
+		  AND r.id > COALESCE(tr.last_read_message_id, 0)
+	`, userID, rootID).Scan(&count)
+	return count, err
+}
+
+// POST /messages/{id}/thread/read
+// body の message_id まで（省略時は最新の返信まで）スレッドを既読にする
+func MarkThreadAsReadHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		msgID, _, err := parseMessagePath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			MessageID int `json:"message_id"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		roomID, rootID, err := threadRootOf(r.Context(), db, msgID)
+		if err != nil {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+
+		// 指定された位置は、このスレッドの返信でなければ受け付けない
+		if req.MessageID != 0 {
+			var inThread bool
+			err := db.QueryRow(r.Context(),
+				`SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND parent_message_id = $2 AND room_id = $3)`,
+				req.MessageID, rootID, roomID,
+			).Scan(&inThread)
+			if err != nil {
+				log.Println("スレッド既読の確認失敗:", err)
+				http.Error(w, "Failed to mark thread as read", http.StatusInternalServerError)
+				return
+			}
+			if !inThread {
+				http.Error(w, "スレッドの返信ではありません", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// 既読位置は後退させない（既存の位置と比べて大きい方を残す）
+		var lastRead int
+		err = db.QueryRow(r.Context(), `
+			INSERT INTO thread_reads (user_id, root_message_id, last_read_message_id)
+			SELECT $1, $2, COALESCE(NULLIF($3, 0), MAX(id), 0)
+			FROM messages WHERE parent_message_id = $2
+			ON CONFLICT (user_id, root_message_id) DO UPDATE
+			  SET last_read_message_id = GREATEST(thread_reads.last_read_message_id, EXCLUDED.last_read_message_id),
+			      updated_at = now()
+			RETURNING last_read_message_id
+		`, userID, rootID, req.MessageID).Scan(&lastRead)
+		if err != nil {
+			log.Println("スレッド既読保存失敗:", err)
+			http.Error(w, "Failed to mark thread as read", http.StatusInternalServerError)
+			return
+		}
+
+		// 自分の他の接続の未読表示も消す
+		hub.SendToUser(userID, map[string]interface{}{
+			"type":                 "thread_read",
+			"room_id":              roomID,
+			"root_message_id":      rootID,
+			"last_read_message_id": lastRead,
+		})
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// GET /thread_unread?room=…
+// 自分が投稿・返信したスレッドのうち、未読の返信があるものとその件数
+func GetThreadUnreadCountsHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		roomIDStr := r.URL.Query().Get("room")
+		roomID, err := strconv.Atoi(roomIDStr)
+		if err != nil {
+			http.Error(w, "Invalid room ID", http.StatusBadRequest)
+			return
+		}
+
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+
+		rows, err := db.Query(r.Context(), `
+			SELECT r.parent_message_id, COUNT(*)
+			FROM messages r
+			JOIN messages root ON root.id = r.parent_message_id
+			LEFT JOIN thread_reads tr ON tr.root_message_id = root.id AND tr.user_id = $2
+			WHERE root.room_id = $1
+			  AND r.sender_id != $2
+			  AND r.id > COALESCE(tr.last_read_message_id, 0)
+			  AND (root.sender_id = $2 OR EXISTS (
+			    SELECT 1 FROM messages mine
+			    WHERE mine.parent_message_id = root.id AND mine.sender_id = $2
+			  ))
+			GROUP BY r.parent_message_id
+		`, roomID, userID)
+		if err != nil {
+			log.Printf("スレッド未読数取得失敗: %v", err)
+			http.Error(w, "Failed to count unread", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		type threadUnread struct {
+			RootMessageID int `json:"root_message_id"`
+			UnreadCount   int `json:"unread_count"`
+		}
+		result := []threadUnread{}
+		for rows.Next() {
+			var t threadUnread
+			if err := rows.Scan(&t.RootMessageID, &t.UnreadCount); err == nil {
+				result = append(result, t)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
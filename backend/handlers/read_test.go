@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"backend/config"
+)
+
+func TestMessageReaders(t *testing.T) {
+	e := newTestEnv(t)
+	alice, aliceToken := e.user(t, "alice")
+	bob, _ := e.user(t, "bob")
+	carol, _ := e.user(t, "carol")
+	roomID := e.group(t, "readers", alice, bob, carol)
+	msgID := e.message(t, roomID, alice, "hello")
+
+	if _, err := advanceReadCursor(context.Background(), e.db, roomID, bob, msgID); err != nil {
+		t.Fatal(err)
+	}
+
+	h := MessageResourceHandler(e.db, e.tokens, e.hub, e.authz, config.Default().Messages)
+	rec := serve(t, h, http.MethodGet, fmt.Sprintf("/messages/%d/readers", msgID), aliceToken, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+
+	var res MessageReaders
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Read) != 1 || res.Read[0].UserID != bob {
+		t.Errorf("read = %+v, want bob だけ", res.Read)
+	}
+	if len(res.Unread) != 1 || res.Unread[0].UserID != carol {
+		t.Errorf("unread = %+v, want carol だけ", res.Unread)
+	}
+}
+
+func TestMessageReadersNonMember(t *testing.T) {
+	e := newTestEnv(t)
+	alice, _ := e.user(t, "alice")
+	_, malloryToken := e.user(t, "mallory")
+	roomID := e.group(t, "readers", alice)
+	msgID := e.message(t, roomID, alice, "hello")
+
+	h := MessageResourceHandler(e.db, e.tokens, e.hub, e.authz, config.Default().Messages)
+	rec := serve(t, h, http.MethodGet, fmt.Sprintf("/messages/%d/readers", msgID), malloryToken, nil)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,174 @@
+// サイドバー用のルーム一覧（DM とグループをまとめて、最後の発言・未読数付きで返す）
+package handlers
+
+import (
+	"backend/utils"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const lastMessagePreviewLength = 100
+
+// 最後の発言（タイムラインの発言だけ。スレッド返信は含めない）
+type LastMessagePreview struct {
+	ID            int    `json:"id"`
+	Username      string `json:"username"`
+	Text          string `json:"text"` // 先頭 lastMessagePreviewLength 文字。削除済みなら空
+	Kind          string `json:"kind"`
+	Deleted       bool   `json:"deleted"`
+	HasAttachment bool   `json:"has_attachment"`
+	HasStamp      bool   `json:"has_stamp"`
+	CreatedAt     string `json:"created_at"`
+}
+
+type RoomSummary struct {
+	RoomID             int                 `json:"room_id"`
+	Type               string              `json:"type"` // "direct" か "group"
+	Name               string              `json:"name"` // グループ名。DM は相手のユーザー名
+	PeerID             *int                `json:"peer_id,omitempty"`
+	IconURL            string              `json:"icon_url,omitempty"`
+	Archived           bool                `json:"archived"`
+	LastMessage        *LastMessagePreview `json:"last_message"`
+	LastActivityAt     string              `json:"last_activity_at"` // 最後の発言（なければ作成）の時刻
+	UnreadCount        int                 `json:"unread_count"`
+	UnreadMentionCount int                 `json:"unread_mention_count"`
+}
+
+// 未読の数え方は /unread_count と同じ（自分の発言とスレッド返信は数えない）
+// 最後の発言と DM の相手はルームごとに LATERAL で引き、未読数はまとめて集計して1回のクエリで返す
+const roomListQuery = `
+WITH my_rooms AS (
+	SELECT room_id, COALESCE(last_read_message_id, 0) AS read_cursor FROM room_members WHERE user_id = $1
+),
+unread AS (
+	SELECT m.room_id, COUNT(*) AS n
+	FROM my_rooms r
+	JOIN messages m ON m.room_id = r.room_id AND m.id > r.read_cursor
+	WHERE m.sender_id <> $1
+	  AND m.parent_message_id IS NULL
+	  AND NOT m.deleted
+	GROUP BY m.room_id
+),
+unread_mentions AS (
+	SELECT m.room_id, COUNT(*) AS n
+	FROM mentions mn
+	JOIN messages m ON m.id = mn.message_id
+	JOIN my_rooms r ON r.room_id = m.room_id AND m.id > r.read_cursor
+	WHERE mn.mention_target_id = $1
+	  AND m.sender_id <> $1
+	  AND m.parent_message_id IS NULL
+	  AND NOT m.deleted
+	GROUP BY m.room_id
+)
+SELECT cr.id, cr.is_group, COALESCE(cr.room_name, ''), COALESCE(cr.icon_url, ''), cr.archived_at IS NOT NULL,
+       peer.user_id, COALESCE(peer.username, ''),
+       lm.id, COALESCE(lm.text, ''), COALESCE(lm.username, ''), COALESCE(lm.kind, ''),
+       COALESCE(lm.deleted, false), COALESCE(lm.has_attachment, false), COALESCE(lm.has_stamp, false), lm.created_at,
+       GREATEST(cr.created_at, lm.created_at) AS last_activity,
+       COALESCE(u.n, 0), COALESCE(um.n, 0)
+FROM my_rooms r
+JOIN chat_rooms cr ON cr.id = r.room_id
+LEFT JOIN LATERAL (
+	SELECT o.user_id, ou.username
+	FROM room_members o
+	JOIN users ou ON ou.id = o.user_id
+	WHERE o.room_id = cr.id AND o.user_id <> $1
+	ORDER BY o.user_id
+	LIMIT 1
+) peer ON NOT cr.is_group
+LEFT JOIN LATERAL (
+	SELECT m.id, m.text, su.username, m.kind, m.deleted, m.stamp_id IS NOT NULL AS has_stamp, m.created_at,
+	       EXISTS (SELECT 1 FROM message_attachments a WHERE a.message_id = m.id) AS has_attachment
+	FROM messages m
+	JOIN users su ON su.id = m.sender_id
+	WHERE m.room_id = cr.id AND m.parent_message_id IS NULL
+	ORDER BY m.created_at DESC, m.id DESC
+	LIMIT 1
+) lm ON true
+LEFT JOIN unread u ON u.room_id = cr.id
+LEFT JOIN unread_mentions um ON um.room_id = cr.id
+WHERE cr.archived_at IS NULL OR $2
+ORDER BY last_activity DESC, cr.id DESC`
+
+// GET /rooms                 所属する全ルーム（アーカイブ済みを除く）。最後の発言が新しい順
+// GET /rooms?archived=true   アーカイブ済みも含める
+func ListRoomsHandler(db *pgxpool.Pool, tokens *utils.TokenManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "認証エラー", http.StatusUnauthorized)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+			return
+		}
+
+		rows, err := db.Query(r.Context(), roomListQuery, userID, r.URL.Query().Get("archived") == "true")
+		if err != nil {
+			log.Println("ルーム一覧取得失敗:", err)
+			http.Error(w, "DB取得失敗", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		rooms := []RoomSummary{}
+		for rows.Next() {
+			var s RoomSummary
+			var isGroup bool
+			var peerName string
+			var lastID *int
+			var last LastMessagePreview
+			var lastAt *time.Time
+			var activity time.Time
+			err := rows.Scan(&s.RoomID, &isGroup, &s.Name, &s.IconURL, &s.Archived,
+				&s.PeerID, &peerName,
+				&lastID, &last.Text, &last.Username, &last.Kind,
+				&last.Deleted, &last.HasAttachment, &last.HasStamp, &lastAt,
+				&activity, &s.UnreadCount, &s.UnreadMentionCount)
+			if err != nil {
+				log.Println("ルーム一覧の読み込み失敗:", err)
+				http.Error(w, "DB取得失敗", http.StatusInternalServerError)
+				return
+			}
+
+			s.Type = "group"
+			if !isGroup {
+				s.Type = "direct"
+				s.Name = peerName
+			}
+			if lastID != nil {
+				last.ID = *lastID
+				last.CreatedAt = lastAt.Format(time.RFC3339)
+				last.Text = previewText(last.Text, last.Deleted)
+				s.LastMessage = &last
+			}
+			s.LastActivityAt = activity.Format(time.RFC3339)
+			rooms = append(rooms, s)
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("ルーム一覧の読み込み失敗:", err)
+			http.Error(w, "DB取得失敗", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rooms)
+	}
+}
+
+func previewText(text string, deleted bool) string {
+	if deleted {
+		return ""
+	}
+	if utf8.RuneCountInString(text) <= lastMessagePreviewLength {
+		return text
+	}
+	return string([]rune(text)[:lastMessagePreviewLength]) + "…"
+}
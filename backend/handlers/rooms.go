@@ -2,15 +2,19 @@ package handlers
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-	"sort"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
+	"backend/config"
 	"backend/utils"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -21,13 +25,28 @@ type RoomRequest struct {
 }
 
 type RoomResponse struct {
-	RoomID int `json:"room_id"`
+	RoomID  int  `json:"room_id"`
+	Created bool `json:"created"` // false なら既存の DM を返した
+}
+
+var (
+	errDuplicateMember = errors.New("同じユーザーが重複しています")
+	errGroupNameTaken  = errors.New("同名のグループが既に存在します")
+)
+
+// 1対1のルームの組み合わせキー。どちらから開いても同じになるよう小さいIDを先にする
+func dmKey(a, b int) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d:%d", a, b)
 }
 
 // POST /rooms
-func GetOrCreateRoomHandler(db *pgxpool.Pool) http.HandlerFunc {
+// 1対1のルームは dm_key で一意になるので、同時に開かれても同じルームを返す
+func GetOrCreateRoomHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "認証エラー", http.StatusUnauthorized)
 			return
@@ -38,81 +57,164 @@ func GetOrCreateRoomHandler(db *pgxpool.Pool) http.HandlerFunc {
 			http.Error(w, "不正なリクエスト形式", http.StatusBadRequest)
 			return
 		}
+		req.Name = strings.TrimSpace(req.Name)
 
+		// 作成者が先頭（グループのオーナー）
 		allMembers := append([]string{username}, req.Members...)
-
-		userIDs := []int{}
+		seen := make(map[string]bool, len(allMembers))
 		for _, uname := range allMembers {
-			var uid int
-			err := db.QueryRow(context.Background(),
-				`SELECT id FROM users WHERE username = $1`, uname).Scan(&uid)
-			if err != nil {
-				http.Error(w, "ユーザーID取得失敗: "+uname, http.StatusBadRequest)
-				return
-			}
-			userIDs = append(userIDs, uid)
-		}
-
-		memberCount := len(userIDs)
-		var roomID int
-
-		if !req.IsGroup && memberCount == 2 {
-			sort.Ints(userIDs)
-			err := db.QueryRow(context.Background(), `
-				SELECT rm.room_id
-				FROM room_members rm
-				JOIN chat_rooms cr ON cr.id = rm.room_id
-				WHERE cr.is_group = false
-				GROUP BY rm.room_id
-				HAVING COUNT(*) = 2 AND
-				       ARRAY_AGG(rm.user_id ORDER BY rm.user_id) = ARRAY[$1, $2]::int[]
-			`, userIDs[0], userIDs[1]).Scan(&roomID)
-
-			if err == nil {
-				json.NewEncoder(w).Encode(RoomResponse{RoomID: roomID})
+			if seen[uname] {
+				http.Error(w, errDuplicateMember.Error()+": "+uname, http.StatusBadRequest)
 				return
 			}
+			seen[uname] = true
+		}
+		if !req.IsGroup && len(allMembers) != 2 {
+			http.Error(w, "1対1のルームは相手を1人だけ指定してください", http.StatusBadRequest)
+			return
+		}
+		if req.IsGroup && utf8.RuneCountInString(req.Name) > maxRoomNameLength {
+			http.Error(w, "グループ名は50文字以内にしてください", http.StatusBadRequest)
+			return
 		}
 
-		if req.IsGroup && memberCount >= 3 && req.Name != "" {
-			var exists bool
-			err := db.QueryRow(context.Background(), `
-				SELECT EXISTS (
-					SELECT 1 FROM chat_rooms
-					WHERE is_group = true AND room_name = $1
-				)
-			`, req.Name).Scan(&exists)
-			if err == nil && exists {
-				http.Error(w, "同名のグループが既に存在します", http.StatusConflict)
+		userIDs, err := userIDsByName(r.Context(), db, allMembers)
+		if err != nil {
+			log.Println("ユーザーID取得失敗:", err)
+			http.Error(w, "ユーザーID取得失敗", http.StatusInternalServerError)
+			return
+		}
+		for i, uname := range allMembers {
+			if userIDs[i] == 0 {
+				http.Error(w, "ユーザーID取得失敗: "+uname, http.StatusBadRequest)
 				return
 			}
 		}
 
-		err = db.QueryRow(context.Background(),
-			`INSERT INTO chat_rooms (is_group, room_name) VALUES ($1, $2) RETURNING id`,
-			req.IsGroup, req.Name).Scan(&roomID)
+		res, err := createRoom(r.Context(), db, req, userIDs)
+		if errors.Is(err, errGroupNameTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		if err != nil {
+			log.Println("ルーム作成失敗:", err)
 			http.Error(w, "ルーム作成に失敗", http.StatusInternalServerError)
 			return
 		}
 
-		for _, uid := range userIDs {
-			_, err := db.Exec(context.Background(),
-				`INSERT INTO room_members (room_id, user_id) VALUES ($1, $2)`,
-				roomID, uid)
+		w.Header().Set("Content-Type", "application/json")
+		if res.Created {
+			for _, uid := range userIDs {
+				// 接続中のメンバーにも新しいルームのイベントが届くようにする
+				hub.JoinRoom(uid, res.RoomID)
+				hub.SendToUser(uid, map[string]interface{}{
+					"type":    "room_joined",
+					"room_id": res.RoomID,
+				})
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// ルームとメンバーを1トランザクションで作る。userIDs の先頭が作成者
+func createRoom(ctx context.Context, db *pgxpool.Pool, req RoomRequest, userIDs []int) (RoomResponse, error) {
+	var res RoomResponse
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+
+	if req.IsGroup {
+		if req.Name != "" {
+			// 同名チェックと作成の間に同じ名前で作られないよう、名前ごとにロックする
+			if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('room_name:' || $1))`, req.Name); err != nil {
+				return res, err
+			}
+			var exists bool
+			err := tx.QueryRow(ctx,
+				`SELECT EXISTS (SELECT 1 FROM chat_rooms WHERE is_group = true AND room_name = $1)`,
+				req.Name).Scan(&exists)
 			if err != nil {
-				log.Printf("メンバー登録失敗: room=%d user=%d", roomID, uid)
+				return res, err
 			}
+			if exists {
+				return res, errGroupNameTaken
+			}
+		}
+		err = tx.QueryRow(ctx,
+			`INSERT INTO chat_rooms (is_group, room_name) VALUES (true, $1) RETURNING id`,
+			req.Name).Scan(&res.RoomID)
+	} else {
+		// 同時に作られた場合は後の方が衝突して何も入れず、先に作られたルームを引き直す
+		key := dmKey(userIDs[0], userIDs[1])
+		err = tx.QueryRow(ctx,
+			`INSERT INTO chat_rooms (is_group, dm_key) VALUES (false, $1)
+			 ON CONFLICT (dm_key) DO NOTHING RETURNING id`,
+			key).Scan(&res.RoomID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			err = tx.QueryRow(ctx, `SELECT id FROM chat_rooms WHERE dm_key = $1`, key).Scan(&res.RoomID)
+			return res, err
+		}
+	}
+	if err != nil {
+		return res, err
+	}
+
+	roles := make([]string, len(userIDs))
+	for i := range userIDs {
+		roles[i] = roleMember
+	}
+	if req.IsGroup {
+		roles[0] = roleOwner
+	}
+	_, err = tx.Exec(ctx,
+		`INSERT INTO room_members (room_id, user_id, role)
+		 SELECT $1, m.user_id, m.role FROM unnest($2::int[], $3::text[]) AS m(user_id, role)`,
+		res.RoomID, userIDs, roles)
+	if err != nil {
+		return res, err
+	}
+
+	res.Created = true
+	return res, tx.Commit(ctx)
+}
+
+// ユーザー名と同じ順にIDを返す。存在しないユーザーは 0
+func userIDsByName(ctx context.Context, db *pgxpool.Pool, usernames []string) ([]int, error) {
+	rows, err := db.Query(ctx, `SELECT id, username FROM users WHERE username = ANY($1)`, usernames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byName := make(map[string]int, len(usernames))
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
 		}
+		byName[name] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		json.NewEncoder(w).Encode(RoomResponse{RoomID: roomID})
+	ids := make([]int, len(usernames))
+	for i, name := range usernames {
+		ids[i] = byName[name]
 	}
+	return ids, nil
 }
 
 // GET グループ一覧取得
-func GetGroupRoomsHandler(db *pgxpool.Pool) http.HandlerFunc {
+func GetGroupRoomsHandler(db *pgxpool.Pool, tokens *utils.TokenManager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "認証エラー", http.StatusUnauthorized)
 			return
@@ -131,8 +233,9 @@ func GetGroupRoomsHandler(db *pgxpool.Pool) http.HandlerFunc {
 			FROM chat_rooms cr
 			JOIN room_members rm ON cr.id = rm.room_id
 			WHERE cr.is_group = true AND rm.user_id = $1
+			  AND (cr.archived_at IS NULL OR $2)
 			ORDER BY cr.created_at ASC
-		`, userID)
+		`, userID, r.URL.Query().Get("archived") == "true")
 		if err != nil {
 			http.Error(w, "DB取得失敗", http.StatusInternalServerError)
 			return
@@ -157,14 +260,18 @@ func GetGroupRoomsHandler(db *pgxpool.Pool) http.HandlerFunc {
 }
 
 // GETとPOSTを分けて処理する統合ハンドラー
-func RoomsHandler(db *pgxpool.Pool) http.HandlerFunc {
+func RoomsHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
-			GetOrCreateRoomHandler(db)(w, r)
+			GetOrCreateRoomHandler(db, tokens, hub)(w, r)
 			return
 		}
 		if r.Method == http.MethodGet && r.URL.Query().Get("type") == "group" {
-			GetGroupRoomsHandler(db)(w, r)
+			GetGroupRoomsHandler(db, tokens)(w, r)
+			return
+		}
+		if r.Method == http.MethodGet {
+			ListRoomsHandler(db, tokens)(w, r)
 			return
 		}
 
@@ -173,63 +280,93 @@ func RoomsHandler(db *pgxpool.Pool) http.HandlerFunc {
 }
 
 // GET /rooms/{id}
-func GetRoomDetailHandler(db *pgxpool.Pool) http.HandlerFunc {
+func GetRoomDetailHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		_, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			http.Error(w, "認証エラー", http.StatusUnauthorized)
 			return
 		}
 
-		roomIDStr := r.URL.Path[len("/rooms/"):]
-		roomID, err := strconv.Atoi(roomIDStr)
+		roomID, _, err := parseRoomPath(r.URL.Path)
 		if err != nil {
 			http.Error(w, "ルームIDが無効です", http.StatusBadRequest)
 			return
 		}
 
-		var isGroup bool
-		var roomName sql.NullString
-		err = db.QueryRow(context.Background(), `
-			SELECT is_group, room_name FROM chat_rooms WHERE id = $1
-		`, roomID).Scan(&isGroup, &roomName)
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+
+		room, err := roomMetadata(r.Context(), db, roomID)
 		if err != nil {
 			http.Error(w, "ルームが見つかりません", http.StatusNotFound)
 			return
 		}
 
-		rows, err := db.Query(context.Background(), `
-			SELECT u.username FROM users u
-			JOIN room_members rm ON u.id = rm.user_id
-			WHERE rm.room_id = $1
-		`, roomID)
+		members, err := listRoomMembers(r.Context(), db, roomID)
 		if err != nil {
 			http.Error(w, "メンバー取得失敗", http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var members []string
-		for rows.Next() {
-			var uname string
-			if err := rows.Scan(&uname); err == nil {
-				members = append(members, uname)
-			}
+		var usernames []string
+		for _, m := range members {
+			usernames = append(usernames, m.Username)
 		}
 
 		result := map[string]interface{}{
 			"type":    "direct",
-			"users":   members,
+			"users":   usernames,
+			"members": members, // 役割付き
 			"name":    "",
 			"room_id": roomID,
+
+			"description": room.Description,
+			"icon_url":    room.IconURL,
+			"archived":    room.Archived,
 		}
 
-		if isGroup {
+		if room.IsGroup {
 			result["type"] = "group"
-			result["name"] = roomName.String
+			result["name"] = room.Name
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(result)
 	}
 }
+
+// /rooms/{id} 配下をメソッドとサブパスで振り分ける統合ハンドラー
+func RoomResourceHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer, uploads config.UploadsConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, sub, err := parseRoomPath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "ルームIDが無効です", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case sub == "" && r.Method == http.MethodGet:
+			GetRoomDetailHandler(db, tokens, authz)(w, r)
+		case sub == "" && r.Method == http.MethodPatch:
+			UpdateRoomHandler(db, tokens, hub, uploads)(w, r)
+		case sub == "members" || strings.HasPrefix(sub, "members/"):
+			RoomMembersHandler(db, tokens, hub, authz)(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// /rooms/{id} または /rooms/{id}/{sub} を分解する
+func parseRoomPath(path string) (int, string, error) {
+	rest := strings.TrimPrefix(path, "/rooms/")
+	idStr, sub, _ := strings.Cut(rest, "/")
+	id, err := strconv.Atoi(idStr)
+	return id, sub, err
+}
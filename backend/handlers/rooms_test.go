@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// 同じ2人の DM を両側から同時に開いても、ルームは1つだけ作られる
+func TestGetOrCreateRoomConcurrentDM(t *testing.T) {
+	e := newTestEnv(t)
+	_, aliceToken := e.user(t, "alice")
+	_, bobToken := e.user(t, "bob")
+	h := GetOrCreateRoomHandler(e.db, e.tokens, e.hub)
+
+	const n = 20
+	var (
+		wg      sync.WaitGroup
+		start   = make(chan struct{})
+		codes   = make([]int, n)
+		results = make([]RoomResponse, n)
+	)
+	for i := 0; i < n; i++ {
+		token, partner := aliceToken, "bob"
+		if i%2 == 1 {
+			token, partner = bobToken, "alice"
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			rec := serve(t, h, http.MethodPost, "/rooms", token, RoomRequest{Members: []string{partner}})
+			codes[i] = rec.Code
+			if err := json.NewDecoder(rec.Body).Decode(&results[i]); err != nil {
+				t.Errorf("リクエスト %d: レスポンスのデコード失敗: %v", i, err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created := 0
+	for i, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+		default:
+			t.Fatalf("リクエスト %d: status = %d", i, code)
+		}
+		if results[i].RoomID != results[0].RoomID {
+			t.Errorf("リクエスト %d: room_id = %d, want %d", i, results[i].RoomID, results[0].RoomID)
+		}
+		if results[i].Created != (code == http.StatusCreated) {
+			t.Errorf("リクエスト %d: created = %v, status = %d", i, results[i].Created, code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("201 が %d 件, want 1", created)
+	}
+
+	var rooms, keys, members int
+	err := e.db.QueryRow(context.Background(), `
+		SELECT COUNT(*), COUNT(DISTINCT dm_key),
+		       (SELECT COUNT(*) FROM room_members rm JOIN chat_rooms cr ON cr.id = rm.room_id WHERE NOT cr.is_group)
+		FROM chat_rooms WHERE NOT is_group`).Scan(&rooms, &keys, &members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rooms != 1 || keys != 1 || members != 2 {
+		t.Errorf("ルーム %d 件・dm_key %d 種類・メンバー %d 人, want 1・1・2", rooms, keys, members)
+	}
+}
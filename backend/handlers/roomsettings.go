@@ -0,0 +1,285 @@
+// グループの名前・説明・アイコンの変更とアーカイブ
+package handlers
+
+import (
+	"backend/config"
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	maxRoomNameLength        = 50
+	maxRoomDescriptionLength = 500
+)
+
+// アーカイブ中のルームへの書き込みを断る。見つからなければ errRoomNotFound、アーカイブ中なら errRoomArchived
+// アーカイブと同時の変更も弾けるよう、ルームの行を共有ロックしてから見る
+func lockActiveRoom(ctx context.Context, tx pgx.Tx, roomID int) error {
+	var archived bool
+	err := tx.QueryRow(ctx,
+		`SELECT archived_at IS NOT NULL FROM chat_rooms WHERE id = $1 FOR SHARE`, roomID,
+	).Scan(&archived)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errRoomNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if archived {
+		return errRoomArchived
+	}
+	return nil
+}
+
+// ルームの表示用の情報
+type RoomMetadata struct {
+	RoomID      int    `json:"room_id"`
+	IsGroup     bool   `json:"is_group"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	IconURL     string `json:"icon_url,omitempty"`
+	Archived    bool   `json:"archived"`
+	ArchivedAt  string `json:"archived_at,omitempty"`
+}
+
+// RoomMetadata 1件分のSELECT（cr は chat_rooms）。scanRoomMetadata と対で使う
+const roomMetadataSelect = `SELECT cr.id, cr.is_group, COALESCE(cr.room_name, ''), cr.description,
+	COALESCE(cr.icon_url, ''), cr.archived_at
+	FROM chat_rooms cr`
+
+func scanRoomMetadata(row pgx.Row) (RoomMetadata, error) {
+	var m RoomMetadata
+	var archivedAt *time.Time
+	if err := row.Scan(&m.RoomID, &m.IsGroup, &m.Name, &m.Description, &m.IconURL, &archivedAt); err != nil {
+		return m, err
+	}
+	if archivedAt != nil {
+		m.Archived = true
+		m.ArchivedAt = archivedAt.Format(time.RFC3339)
+	}
+	return m, nil
+}
+
+// 変更する項目だけを送る
+type UpdateRoomRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	IconURL     *string `json:"icon_url"` // /upload が返した画像のURL。"" でアイコンを外す
+	Archived    *bool   `json:"archived"`
+}
+
+// PATCH /rooms/{id}（owner/admin）
+// アーカイブ中のルームは archived: false で戻すまで他の項目を変更できない
+func UpdateRoomHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, uploads config.UploadsConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "認証エラー", http.StatusUnauthorized)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "ユーザーが見つかりません", http.StatusUnauthorized)
+			return
+		}
+		roomID, _, err := parseRoomPath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "ルームIDが無効です", http.StatusBadRequest)
+			return
+		}
+
+		var req UpdateRoomRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "不正なリクエスト形式", http.StatusBadRequest)
+			return
+		}
+		if req.Name == nil && req.Description == nil && req.IconURL == nil && req.Archived == nil {
+			http.Error(w, "変更する項目を指定してください", http.StatusBadRequest)
+			return
+		}
+		if req.Name != nil {
+			name := strings.TrimSpace(*req.Name)
+			if name == "" || utf8.RuneCountInString(name) > maxRoomNameLength {
+				http.Error(w, "グループ名は1〜50文字にしてください", http.StatusBadRequest)
+				return
+			}
+			req.Name = &name
+		}
+		if req.Description != nil && utf8.RuneCountInString(*req.Description) > maxRoomDescriptionLength {
+			http.Error(w, "説明は500文字以内にしてください", http.StatusBadRequest)
+			return
+		}
+		if req.IconURL != nil && *req.IconURL != "" && !isImageUpload(uploads.Dir, *req.IconURL) {
+			http.Error(w, "アイコンにはアップロード済みの画像を指定してください", http.StatusBadRequest)
+			return
+		}
+
+		ctx := r.Context()
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			writeMemberError(w, err)
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		role, err := lockGroupRoom(ctx, tx, roomID, userID)
+		if err != nil {
+			writeMemberError(w, err)
+			return
+		}
+		if role != roleOwner && role != roleAdmin {
+			writeMemberError(w, errMemberDenied)
+			return
+		}
+		current, err := scanRoomMetadata(tx.QueryRow(ctx, roomMetadataSelect+` WHERE cr.id = $1`, roomID))
+		if err != nil {
+			writeMemberError(w, err)
+			return
+		}
+
+		// 変わらない項目は落とす
+		if req.Name != nil && *req.Name == current.Name {
+			req.Name = nil
+		}
+		if req.Description != nil && *req.Description == current.Description {
+			req.Description = nil
+		}
+		if req.IconURL != nil && *req.IconURL == current.IconURL {
+			req.IconURL = nil
+		}
+		if req.Archived != nil && *req.Archived == current.Archived {
+			req.Archived = nil
+		}
+		editing := req.Name != nil || req.Description != nil || req.IconURL != nil
+		if current.Archived && editing && req.Archived == nil {
+			http.Error(w, "アーカイブ中のルームは変更できません", http.StatusConflict)
+			return
+		}
+		if !editing && req.Archived == nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(current)
+			return
+		}
+
+		if req.Name != nil {
+			// createRoom と同じロックを取り、同時の作成・変更で同名にならないようにする
+			if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('room_name:' || $1))`, *req.Name); err != nil {
+				writeMemberError(w, err)
+				return
+			}
+			var exists bool
+			err := tx.QueryRow(ctx,
+				`SELECT EXISTS (SELECT 1 FROM chat_rooms WHERE is_group = true AND room_name = $1 AND id <> $2)`,
+				*req.Name, roomID).Scan(&exists)
+			if err != nil {
+				writeMemberError(w, err)
+				return
+			}
+			if exists {
+				http.Error(w, "同名のグループが既に存在します", http.StatusConflict)
+				return
+			}
+		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE chat_rooms SET
+				room_name   = COALESCE($2, room_name),
+				description = COALESCE($3, description),
+				icon_url    = CASE WHEN $4::text IS NULL THEN icon_url ELSE NULLIF($4, '') END,
+				archived_at = CASE WHEN $5::bool IS NULL THEN archived_at WHEN $5 THEN now() ELSE NULL END,
+				archived_by = CASE WHEN $5::bool IS NULL THEN archived_by WHEN $5 THEN $6 ELSE NULL END,
+				updated_at  = now()
+			WHERE id = $1`,
+			roomID, req.Name, req.Description, req.IconURL, req.Archived, userID)
+		if err != nil {
+			writeMemberError(w, err)
+			return
+		}
+
+		actor := RoomMember{UserID: userID, Username: username}
+		var sysMsgs []*WSMessage
+		for _, c := range roomChanges(req, actor.Username) {
+			m, err := insertSystemMessage(ctx, tx, roomID, actor, c.event, c.text)
+			if err != nil {
+				writeMemberError(w, err)
+				return
+			}
+			sysMsgs = append(sysMsgs, m)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			writeMemberError(w, err)
+			return
+		}
+
+		updated, err := roomMetadata(ctx, db, roomID)
+		if err != nil {
+			log.Println("ルーム情報取得失敗:", err)
+			http.Error(w, "ルーム情報取得失敗", http.StatusInternalServerError)
+			return
+		}
+		for _, m := range sysMsgs {
+			hub.Broadcast(roomID, m)
+		}
+		hub.Broadcast(roomID, map[string]interface{}{
+			"type":    "room_updated",
+			"room_id": roomID,
+			"room":    updated,
+			"by":      actor.Username,
+		})
+		log.Printf("ルーム%d: %s が情報を変更", roomID, actor.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(updated)
+	}
+}
+
+type roomChange struct {
+	event SystemEvent
+	text  string
+}
+
+// 変更内容ごとのシステムメッセージ
+func roomChanges(req UpdateRoomRequest, actor string) []roomChange {
+	var changes []roomChange
+	add := func(action, name, text string) {
+		changes = append(changes, roomChange{
+			event: SystemEvent{Action: action, Actor: actor, Name: name},
+			text:  actor + "さんが" + text,
+		})
+	}
+	if req.Archived != nil && !*req.Archived {
+		add("room_unarchived", "", "グループのアーカイブを解除しました")
+	}
+	if req.Name != nil {
+		add("room_renamed", *req.Name, "グループ名を「"+*req.Name+"」に変更しました")
+	}
+	if req.Description != nil {
+		add("room_description_changed", "", "グループの説明を変更しました")
+	}
+	if req.IconURL != nil {
+		if *req.IconURL == "" {
+			add("room_icon_changed", "", "グループのアイコンを削除しました")
+		} else {
+			add("room_icon_changed", "", "グループのアイコンを変更しました")
+		}
+	}
+	if req.Archived != nil && *req.Archived {
+		add("room_archived", "", "グループをアーカイブしました")
+	}
+	return changes
+}
+
+// ルームの行を取る。見つからなければ pgx.ErrNoRows
+func roomMetadata(ctx context.Context, db *pgxpool.Pool, roomID int) (RoomMetadata, error) {
+	return scanRoomMetadata(db.QueryRow(ctx, roomMetadataSelect+` WHERE cr.id = $1`, roomID))
+}
@@ -0,0 +1,276 @@
+// メッセージ検索
+package handlers
+
+import (
+	"backend/utils"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+	maxSearchTerms        = 5
+	maxSearchQueryLength  = 100 // 文字数
+)
+
+// 本文を一致部分とそれ以外に分けたもの（HTMLに埋め込まずにハイライトできるように）
+type HighlightFragment struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match"`
+}
+
+type SearchResult struct {
+	Message
+	Highlight []HighlightFragment `json:"highlight"`
+}
+
+type SearchPage struct {
+	Results    []SearchResult `json:"results"`
+	NextCursor *int           `json:"next_cursor"` // 次のページの before。続きがなければ null
+}
+
+// 検索条件
+type searchParams struct {
+	Terms         []string
+	RoomID        int
+	Sender        string
+	From, To      time.Time
+	HasAttachment *bool
+	Before        int
+	Limit         int
+}
+
+// GET /search?q=…
+// 任意: room, sender（ユーザー名）, from, to（YYYY-MM-DD か RFC3339。日付のみの to はその日を含む）,
+// has_attachment（true/false）, before（前ページの next_cursor）, limit
+// 空白区切りの語をすべて含むメッセージを、呼び出したユーザーが所属するルームから新しい順に返す
+func SearchHandler(db *pgxpool.Pool, tokens *utils.TokenManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		p, err := parseSearchParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// 所属していないルームを room に指定しても結果が空になるだけ
+		conds := []string{
+			"m.room_id IN (SELECT room_id FROM room_members WHERE user_id = $1)",
+			"m.deleted = false",
+		}
+		args := []interface{}{userID}
+		add := func(cond string, v interface{}) {
+			args = append(args, v)
+			conds = append(conds, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(args))))
+		}
+
+		for _, t := range p.Terms {
+			add(`m.text ILIKE ? ESCAPE '\'`, "%"+escapeLike(t)+"%")
+		}
+		if p.RoomID != 0 {
+			add("m.room_id = ?", p.RoomID)
+		}
+		if p.Sender != "" {
+			add("u.username = ?", p.Sender)
+		}
+		if !p.From.IsZero() {
+			add("m.created_at >= ?", p.From)
+		}
+		if !p.To.IsZero() {
+			add("m.created_at < ?", p.To)
+		}
+		if p.HasAttachment != nil {
+			cond := "EXISTS (SELECT 1 FROM message_attachments a WHERE a.message_id = m.id)"
+			if !*p.HasAttachment {
+				cond = "NOT " + cond
+			}
+			conds = append(conds, cond)
+		}
+		if p.Before != 0 {
+			add("m.id < ?", p.Before)
+		}
+		args = append(args, p.Limit+1)
+
+		rows, err := db.Query(r.Context(),
+			messageSelect+`
+			 WHERE `+strings.Join(conds, " AND ")+`
+			 ORDER BY m.id DESC
+			 LIMIT $`+strconv.Itoa(len(args)), args...)
+		if err != nil {
+			log.Println("検索失敗:", err)
+			http.Error(w, "検索に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		page := SearchPage{Results: []SearchResult{}}
+		for rows.Next() {
+			msg, err := scanMessage(rows)
+			if err != nil {
+				log.Println("行スキャン失敗:", err)
+				continue
+			}
+			page.Results = append(page.Results, SearchResult{
+				Message:   msg,
+				Highlight: highlight(msg.Text, p.Terms),
+			})
+		}
+		if err := rows.Err(); err != nil {
+			log.Println("検索失敗:", err)
+			http.Error(w, "検索に失敗しました", http.StatusInternalServerError)
+			return
+		}
+
+		if len(page.Results) > p.Limit {
+			page.Results = page.Results[:p.Limit]
+			next := page.Results[p.Limit-1].ID
+			page.NextCursor = &next
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+func parseSearchParams(r *http.Request) (searchParams, error) {
+	q := r.URL.Query()
+	p := searchParams{Limit: defaultSearchPageSize}
+	var err error
+
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		return p, errors.New("qパラメータを指定してください")
+	}
+	if utf8.RuneCountInString(query) > maxSearchQueryLength {
+		return p, errors.New("qパラメータが長すぎます")
+	}
+	p.Terms = strings.Fields(query)
+	if len(p.Terms) > maxSearchTerms {
+		return p, errors.New("検索語が多すぎます")
+	}
+
+	if v := q.Get("room"); v != "" {
+		p.RoomID, err = strconv.Atoi(v)
+		if err != nil || p.RoomID < 1 {
+			return p, errors.New("roomパラメータが無効です")
+		}
+	}
+	p.Sender = q.Get("sender")
+	if v := q.Get("from"); v != "" {
+		p.From, _, err = parseSearchTime(v)
+		if err != nil {
+			return p, errors.New("fromパラメータが無効です")
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		var dateOnly bool
+		p.To, dateOnly, err = parseSearchTime(v)
+		if err != nil {
+			return p, errors.New("toパラメータが無効です")
+		}
+		if dateOnly {
+			p.To = p.To.AddDate(0, 0, 1)
+		}
+	}
+	if v := q.Get("has_attachment"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, errors.New("has_attachmentパラメータが無効です")
+		}
+		p.HasAttachment = &b
+	}
+	if v := q.Get("before"); v != "" {
+		p.Before, err = strconv.Atoi(v)
+		if err != nil || p.Before < 1 {
+			return p, errors.New("beforeパラメータが無効です")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		p.Limit, err = strconv.Atoi(v)
+		if err != nil || p.Limit < 1 {
+			return p, errors.New("limitパラメータが無効です")
+		}
+		if p.Limit > maxSearchPageSize {
+			p.Limit = maxSearchPageSize
+		}
+	}
+	return p, nil
+}
+
+// 日付のみ（YYYY-MM-DD）か RFC3339 を受け付ける。日付のみならサーバーのローカル時刻の0時
+func parseSearchTime(v string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, v, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, false, err
+}
+
+// LIKE のワイルドカードをエスケープする
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// 検索語に一致する部分（大文字小文字は区別しない）を印を付けて切り分ける
+func highlight(text string, terms []string) []HighlightFragment {
+	runes := []rune(text)
+	lower := lowerRunes(text)
+
+	marked := make([]bool, len(runes))
+	for _, t := range terms {
+		term := lowerRunes(t)
+		if len(term) == 0 {
+			continue
+		}
+		for i := 0; i+len(term) <= len(lower); i++ {
+			if string(lower[i:i+len(term)]) == string(term) {
+				for j := i; j < i+len(term); j++ {
+					marked[j] = true
+				}
+			}
+		}
+	}
+
+	fragments := []HighlightFragment{}
+	start := 0
+	for i := 1; i <= len(runes); i++ {
+		if i == len(runes) || marked[i] != marked[start] {
+			fragments = append(fragments, HighlightFragment{Text: string(runes[start:i]), Match: marked[start]})
+			start = i
+		}
+	}
+	return fragments
+}
+
+// 1文字ずつ小文字にする（strings.ToLower と違い文字数が変わらない）
+func lowerRunes(s string) []rune {
+	runes := []rune(s)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
@@ -0,0 +1,188 @@
+// ログインセッションの一覧と失効
+// セッション = リフレッシュトークンのファミリー（tokens.go）。アクセストークンの sid に入っている
+package handlers
+
+import (
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type Session struct {
+	ID         string `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"created_at"`
+	LastSeenAt string `json:"last_seen_at"`
+	ExpiresAt  string `json:"expires_at"`
+	Current    bool   `json:"current"` // このリクエストのトークンのセッション
+}
+
+// 接続元IP（プロキシのヘッダーは偽装できるので見ない）
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// セッションを失効させる。リフレッシュトークン・発行済みのアクセストークン・WebSocket接続もまとめて無効にする
+func revokeSession(ctx context.Context, db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, sessionID string) error {
+	var userID int
+	err := db.QueryRow(ctx,
+		`UPDATE sessions SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 RETURNING user_id`,
+		sessionID,
+	).Scan(&userID)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	_, err = db.Exec(ctx,
+		`UPDATE refresh_tokens SET revoked_at = now()
+		 WHERE family_id = $1 AND revoked_at IS NULL`, sessionID)
+	if err != nil {
+		return err
+	}
+	if err := tokens.RevokeSession(ctx, sessionID); err != nil {
+		return err
+	}
+
+	if userID != 0 {
+		hub.DisconnectSession(userID, sessionID)
+	}
+	return nil
+}
+
+// GET    /sessions                    有効なセッションの一覧
+// DELETE /sessions                    全セッションからログアウト（keep_current=true なら自分以外）
+// DELETE /sessions/{id}               指定したセッションからログアウト
+func SessionsHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := tokens.ClaimsFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, claims.Username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		sessionID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+
+		switch {
+		case sessionID == "" && r.Method == http.MethodGet:
+			listSessions(w, r, db, userID, claims.SessionID)
+
+		case sessionID == "" && r.Method == http.MethodDelete:
+			keepCurrent := r.URL.Query().Get("keep_current") == "true"
+			rows, err := db.Query(r.Context(),
+				`SELECT id::text FROM sessions WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+			if err != nil {
+				log.Println("セッション取得失敗:", err)
+				http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+				return
+			}
+			ids, err := pgx.CollectRows(rows, pgx.RowTo[string])
+			if err != nil {
+				log.Println("セッション取得失敗:", err)
+				http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+				return
+			}
+
+			revoked := 0
+			for _, id := range ids {
+				if keepCurrent && id == claims.SessionID {
+					continue
+				}
+				if err := revokeSession(r.Context(), db, tokens, hub, id); err != nil {
+					log.Println("セッション失効失敗:", err)
+					http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+					return
+				}
+				revoked++
+			}
+			// セッションを持たない古いトークンでも、自分のトークンは確実に失効させる
+			if !keepCurrent {
+				tokens.BlacklistToken(r.Context(), claims)
+			}
+			log.Printf("%s が %d 件のセッションからログアウト", claims.Username, revoked)
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"revoked": revoked})
+
+		case sessionID != "" && r.Method == http.MethodDelete:
+			if uuid.Validate(sessionID) != nil {
+				http.Error(w, "Session not found", http.StatusNotFound)
+				return
+			}
+			var exists bool
+			err := db.QueryRow(r.Context(),
+				`SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL)`,
+				sessionID, userID,
+			).Scan(&exists)
+			if err != nil {
+				log.Println("セッション取得失敗:", err)
+				http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+				return
+			}
+			if !exists {
+				http.Error(w, "Session not found", http.StatusNotFound)
+				return
+			}
+			if err := revokeSession(r.Context(), db, tokens, hub, sessionID); err != nil {
+				log.Println("セッション失効失敗:", err)
+				http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func listSessions(w http.ResponseWriter, r *http.Request, db *pgxpool.Pool, userID int, currentID string) {
+	rows, err := db.Query(r.Context(),
+		`SELECT id::text, user_agent, ip, created_at, last_seen_at, expires_at
+		 FROM sessions
+		 WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+		 ORDER BY last_seen_at DESC`, userID)
+	if err != nil {
+		log.Println("セッション取得失敗:", err)
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		var createdAt, lastSeenAt, expiresAt time.Time
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &createdAt, &lastSeenAt, &expiresAt); err != nil {
+			log.Println("行スキャン失敗:", err)
+			continue
+		}
+		s.CreatedAt = createdAt.Format(time.RFC3339)
+		s.LastSeenAt = lastSeenAt.Format(time.RFC3339)
+		s.ExpiresAt = expiresAt.Format(time.RFC3339)
+		s.Current = s.ID == currentID
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
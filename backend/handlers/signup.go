@@ -3,9 +3,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -31,6 +33,14 @@ func SignupHandler(db *pgxpool.Pool) http.HandlerFunc {
 			return
 		}
 
+		//入力チェック（項目ごとのエラーをまとめて返す）
+		req.Username = normalizeUsername(req.Username)
+		fieldErrs := append(validateUsername(req.Username), validatePassword(req.Password, req.Username)...)
+		if len(fieldErrs) > 0 {
+			writeFieldErrors(w, http.StatusBadRequest, fieldErrs)
+			return
+		}
+
 		//パスワードのハッシュ化
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 		if err != nil {
@@ -39,7 +49,16 @@ func SignupHandler(db *pgxpool.Pool) http.HandlerFunc {
 		}
 
 		//ユーザー情報をデータベースに登録
-		_, err = db.Exec(r.Context(), `INSERT INTO users (username, password_hash) VALUES ($1, $2)`, req.Username, string(hashedPassword))
+		_, err = db.Exec(r.Context(),
+			`INSERT INTO users (username, username_key, password_hash) VALUES ($1, $2, $3)`,
+			req.Username, usernameKey(req.Username), string(hashedPassword))
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			writeFieldErrors(w, http.StatusConflict, []FieldError{{
+				Field: "username", Code: "taken", Message: "このユーザー名は既に使われています",
+			}})
+			return
+		}
 		if err != nil {
 			log.Println("INSERT失敗:", err)
 			http.Error(w, "ユーザー登録に失敗しました", http.StatusInternalServerError)
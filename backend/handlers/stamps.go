@@ -0,0 +1,383 @@
+// スタンプカタログとスタンプパック
+package handlers
+
+import (
+	"backend/config"
+	"backend/utils"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	maxStampsPerPack   = 40
+	maxStampDimension  = 1024 // 縦横それぞれの上限(px)
+	recentStampsLimit  = 16
+	maxStampNameLength = 64
+)
+
+// 受け付ける画像形式と保存時の拡張子
+var stampExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+var errInvalidStamp = errors.New("スタンプが見つかりません")
+
+type Stamp struct {
+	ID       int    `json:"id"`
+	PackID   int    `json:"pack_id"`
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	MimeType string `json:"mime_type"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+}
+
+type StampPack struct {
+	ID          int     `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Stamps      []Stamp `json:"stamps"`
+}
+
+type StampCatalog struct {
+	Packs  []StampPack `json:"packs"`
+	Recent []Stamp     `json:"recent"` // 呼び出したユーザーが最近使った順
+}
+
+// Stamp 1件分のJSONオブジェクト（st は stamps の別名）
+const stampJSONObject = `json_build_object(
+	'id', st.id, 'pack_id', st.pack_id, 'name', st.name, 'url', st.file_url,
+	'mime_type', st.mime_type, 'width', COALESCE(st.width, 0), 'height', COALESCE(st.height, 0))`
+
+// GET /stamps
+func GetStampsHandler(db *pgxpool.Pool, tokens *utils.TokenManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		catalog := StampCatalog{Packs: []StampPack{}, Recent: []Stamp{}}
+
+		rows, err := db.Query(r.Context(),
+			`SELECT p.id, p.name, p.description,
+			        COALESCE((SELECT json_agg(`+stampJSONObject+` ORDER BY st.position, st.id)
+			                  FROM stamps st WHERE st.pack_id = p.id), '[]'::json)
+			 FROM stamp_packs p
+			 ORDER BY p.id`)
+		if err != nil {
+			log.Println("スタンプ一覧取得失敗:", err)
+			http.Error(w, "Failed to fetch stamps", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var p StampPack
+			if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Stamps); err != nil {
+				log.Println("行スキャン失敗:", err)
+				continue
+			}
+			catalog.Packs = append(catalog.Packs, p)
+		}
+		rows.Close()
+
+		err = db.QueryRow(r.Context(),
+			`SELECT COALESCE(json_agg(`+stampJSONObject+` ORDER BY su.used_at DESC), '[]'::json)
+			 FROM (SELECT stamp_id, used_at FROM stamp_usages
+			       WHERE user_id = $1 ORDER BY used_at DESC LIMIT $2) su
+			 JOIN stamps st ON st.id = su.stamp_id`,
+			userID, recentStampsLimit,
+		).Scan(&catalog.Recent)
+		if err != nil {
+			log.Println("最近使ったスタンプ取得失敗:", err)
+			http.Error(w, "Failed to fetch stamps", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(catalog)
+	}
+}
+
+// 検証済みのスタンプ画像
+type stampUpload struct {
+	name     string
+	mimeType string
+	data     []byte
+	width    int
+	height   int
+}
+
+// POST /stamps/packs （管理者のみ）
+// multipart/form-data: name, description, stamps（画像ファイルを複数）
+func UploadStampPackHandler(db *pgxpool.Pool, tokens *utils.TokenManager, cfg config.StampsConfig, admins []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !slices.Contains(admins, username) {
+			http.Error(w, "スタンプパックを追加する権限がありません", http.StatusForbidden)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxPackBytes)
+		if err := r.ParseMultipartForm(cfg.MaxPackBytes); err != nil {
+			http.Error(w, "ファイルサイズが大きすぎます", http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		packName := strings.TrimSpace(r.FormValue("name"))
+		if packName == "" || len(packName) > maxStampNameLength {
+			http.Error(w, "パック名が不正です", http.StatusBadRequest)
+			return
+		}
+		description := strings.TrimSpace(r.FormValue("description"))
+
+		files := r.MultipartForm.File["stamps"]
+		if len(files) == 0 || len(files) > maxStampsPerPack {
+			http.Error(w, fmt.Sprintf("スタンプは1〜%d枚で指定してください", maxStampsPerPack), http.StatusBadRequest)
+			return
+		}
+
+		uploads := make([]stampUpload, 0, len(files))
+		seen := make(map[string]bool, len(files))
+		for _, fh := range files {
+			if fh.Size > cfg.MaxFileBytes {
+				http.Error(w, fmt.Sprintf("%s: スタンプ1枚は%dバイトまでです", fh.Filename, cfg.MaxFileBytes), http.StatusBadRequest)
+				return
+			}
+			f, err := fh.Open()
+			if err != nil {
+				http.Error(w, "ファイル読み込み失敗", http.StatusBadRequest)
+				return
+			}
+			data, err := io.ReadAll(io.LimitReader(f, cfg.MaxFileBytes+1))
+			f.Close()
+			if err != nil || int64(len(data)) > cfg.MaxFileBytes {
+				http.Error(w, fh.Filename+": ファイル読み込み失敗", http.StatusBadRequest)
+				return
+			}
+
+			up, err := validateStampImage(fh.Filename, data)
+			if err != nil {
+				http.Error(w, fh.Filename+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if seen[up.name] {
+				http.Error(w, "スタンプ名が重複しています: "+up.name, http.StatusBadRequest)
+				return
+			}
+			seen[up.name] = true
+			uploads = append(uploads, up)
+		}
+
+		pack, err := saveStampPack(r.Context(), db, cfg.Dir, userID, packName, description, uploads)
+		if errors.Is(err, pgx.ErrNoRows) {
+			http.Error(w, "同じ名前のパックが既にあります", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Println("スタンプパック保存失敗:", err)
+			http.Error(w, "保存に失敗しました", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("スタンプパック追加: %s (%d 枚, by %s)", pack.Name, len(pack.Stamps), username)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pack)
+	}
+}
+
+// 形式・大きさを確かめ、ファイル名からスタンプ名を決める
+func validateStampImage(filename string, data []byte) (stampUpload, error) {
+	up := stampUpload{data: data, mimeType: http.DetectContentType(data)}
+	if _, ok := stampExtensions[up.mimeType]; !ok {
+		return up, errors.New("PNG・GIF・WebP 以外の形式は使えません")
+	}
+
+	if up.mimeType == "image/webp" {
+		var ok bool
+		if up.width, up.height, ok = webpSize(data); !ok {
+			return up, errors.New("WebP として読み込めません")
+		}
+	} else {
+		ic, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return up, errors.New("画像として読み込めません")
+		}
+		up.width, up.height = ic.Width, ic.Height
+	}
+	if up.width <= 0 || up.height <= 0 || up.width > maxStampDimension || up.height > maxStampDimension {
+		return up, fmt.Errorf("画像は縦横%dpx以内にしてください", maxStampDimension)
+	}
+
+	base := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	up.name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, base)
+	if up.name == "" || len(up.name) > maxStampNameLength {
+		return up, errors.New("ファイル名が不正です")
+	}
+	return up, nil
+}
+
+// image/webp のデコーダーは標準ライブラリにないので、RIFFヘッダーから大きさだけ読む
+func webpSize(b []byte) (int, int, bool) {
+	if len(b) < 30 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return 0, 0, false
+	}
+	le24 := func(p []byte) int { return int(p[0]) | int(p[1])<<8 | int(p[2])<<16 }
+
+	switch string(b[12:16]) {
+	case "VP8X": // 拡張形式: キャンバスの幅-1・高さ-1 を24bitずつ
+		return le24(b[24:27]) + 1, le24(b[27:30]) + 1, true
+	case "VP8L": // ロスレス: 署名 0x2f の後に幅-1・高さ-1 を14bitずつ
+		if b[20] != 0x2f {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(b[21:25])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, true
+	case "VP8 ": // ロッシー: キーフレームの開始コードの後に幅・高さを14bitずつ
+		if b[23] != 0x9d || b[24] != 0x01 || b[25] != 0x2a {
+			return 0, 0, false
+		}
+		return int(binary.LittleEndian.Uint16(b[26:28]) & 0x3fff), int(binary.LittleEndian.Uint16(b[28:30]) & 0x3fff), true
+	}
+	return 0, 0, false
+}
+
+// パックとスタンプを登録し、画像を dir/<パックID>/ に書き出す
+// 同名のパックがあれば pgx.ErrNoRows を返す
+func saveStampPack(ctx context.Context, db *pgxpool.Pool, dir string, userID int, name, description string, uploads []stampUpload) (StampPack, error) {
+	pack := StampPack{Name: name, Description: description}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return pack, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx,
+		`INSERT INTO stamp_packs (name, description, created_by) VALUES ($1, $2, $3)
+		 ON CONFLICT (name) DO NOTHING RETURNING id`,
+		name, description, userID,
+	).Scan(&pack.ID)
+	if err != nil {
+		return pack, err
+	}
+
+	packDir := filepath.Join(dir, strconv.Itoa(pack.ID))
+	if err := os.MkdirAll(packDir, os.ModePerm); err != nil {
+		return pack, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.RemoveAll(packDir)
+		}
+	}()
+
+	for i, up := range uploads {
+		fileName := randomString(8) + stampExtensions[up.mimeType]
+		if err := os.WriteFile(filepath.Join(packDir, fileName), up.data, 0o644); err != nil {
+			return pack, err
+		}
+
+		s := Stamp{
+			PackID:   pack.ID,
+			Name:     up.name,
+			URL:      fmt.Sprintf("/stamps/%d/%s", pack.ID, fileName),
+			MimeType: up.mimeType,
+			Width:    up.width,
+			Height:   up.height,
+		}
+		err := tx.QueryRow(ctx,
+			`INSERT INTO stamps (pack_id, name, file_url, mime_type, size_bytes, width, height, position)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+			s.PackID, s.Name, s.URL, s.MimeType, len(up.data), s.Width, s.Height, i,
+		).Scan(&s.ID)
+		if err != nil {
+			return pack, err
+		}
+		pack.Stamps = append(pack.Stamps, s)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return pack, err
+	}
+	committed = true
+	return pack, nil
+}
+
+// スタンプの画像URLを返し、送信者の最近使ったスタンプを更新する（createMessage のトランザクション内で呼ぶ）
+func useStamp(ctx context.Context, tx pgx.Tx, userID, stampID int) (string, error) {
+	var url string
+	err := tx.QueryRow(ctx, `SELECT file_url FROM stamps WHERE id = $1`, stampID).Scan(&url)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errInvalidStamp
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO stamp_usages (user_id, stamp_id) VALUES ($1, $2)
+		 ON CONFLICT (user_id, stamp_id)
+		 DO UPDATE SET use_count = stamp_usages.use_count + 1, used_at = now()`,
+		userID, stampID)
+	return url, err
+}
+
+// image に /stamps/… を入れて送ってくる古いクライアント向けに、URLからスタンプIDを引く
+func stampIDByURL(ctx context.Context, db *pgxpool.Pool, url string) (int, error) {
+	var id int
+	err := db.QueryRow(ctx, `SELECT id FROM stamps WHERE file_url = $1`, url).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, errInvalidStamp
+	}
+	return id, err
+}
@@ -0,0 +1,95 @@
+// スレッド返信
+package handlers
+
+import (
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// スレッド1件分のレスポンス
+type ThreadResponse struct {
+	Root        Message   `json:"root"`
+	Replies     []Message `json:"replies"`
+	NextCursor  *int      `json:"next_cursor"`
+	UnreadCount int       `json:"unread_count"`
+}
+
+// メッセージが属するルームと、スレッド先頭のIDを返す（先頭なら自分自身）
+func threadRootOf(ctx context.Context, db *pgxpool.Pool, messageID int) (roomID, rootID int, err error) {
+	err = db.QueryRow(ctx,
+		`SELECT room_id, COALESCE(parent_message_id, id) FROM messages WHERE id = $1`,
+		messageID,
+	).Scan(&roomID, &rootID)
+	return roomID, rootID, err
+}
+
+// GET /messages/{id}/thread?before=…|after=…&limit=…
+// {id} が返信の場合もそのスレッド全体を返す
+func ThreadHandler(db *pgxpool.Pool, tokens *utils.TokenManager, authz *RoomAuthorizer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		msgID, _, err := parseMessagePath(r.URL.Path)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+
+		p, err := parsePageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		roomID, rootID, err := threadRootOf(r.Context(), db, msgID)
+		if err != nil {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		if !authz.Require(w, r, roomID, userID) {
+			return
+		}
+
+		root, err := scanMessage(db.QueryRow(r.Context(), messageSelect+` WHERE m.id = $1`, rootID))
+		if err != nil {
+			log.Println("スレッド先頭取得失敗:", err)
+			http.Error(w, "Failed to get thread", http.StatusInternalServerError)
+			return
+		}
+
+		page, err := queryMessagePage(r.Context(), db, "m.parent_message_id = $1", rootID, p)
+		if err != nil {
+			log.Println("スレッド返信取得失敗:", err)
+			http.Error(w, "Failed to get thread", http.StatusInternalServerError)
+			return
+		}
+
+		unread, err := threadUnreadCount(r.Context(), db, userID, rootID)
+		if err != nil {
+			log.Println("スレッド未読数取得失敗:", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ThreadResponse{
+			Root:        root,
+			Replies:     page.Messages,
+			NextCursor:  page.NextCursor,
+			UnreadCount: unread,
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// ログイン試行の制限
+// 失敗回数をユーザー名ごと・IPごとに Redis で数え、一定回数を超えたら
+// 失敗のたびに倍になる待ち時間を課し、さらに超えたら一定時間ロックする
+package handlers
+
+import (
+	"backend/config"
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	loginFailPrefix = "login_fail:" // 失敗回数。TTL は LockoutDuration
+	loginWaitPrefix = "login_wait:" // 次に試せるまでの待ち時間
+)
+
+type LoginGuard struct {
+	rdb *redis.Client
+	cfg config.LoginConfig
+}
+
+func NewLoginGuard(rdb *redis.Client, cfg config.LoginConfig) *LoginGuard {
+	return &LoginGuard{rdb: rdb, cfg: cfg}
+}
+
+type guardKey struct {
+	name      string
+	threshold int // ロックする失敗回数
+}
+
+func (g *LoginGuard) keys(username, ip string) []guardKey {
+	return []guardKey{
+		{name: "user:" + username, threshold: g.cfg.LockoutAttempts},
+		{name: "ip:" + ip, threshold: g.cfg.IPLockoutAttempts},
+	}
+}
+
+// 今ログインを試してよいか。だめなら再試行までの時間を返す
+// Redis に繋がらないときはログインできなくなるよりはよいので通す
+func (g *LoginGuard) RetryAfter(ctx context.Context, username, ip string) time.Duration {
+	var wait time.Duration
+	for _, k := range g.keys(username, ip) {
+		n, err := g.rdb.Get(ctx, loginFailPrefix+k.name).Int()
+		if err != nil && err != redis.Nil {
+			log.Println("ログイン試行回数の取得失敗:", err)
+			return 0
+		}
+		if n >= k.threshold {
+			wait = max(wait, g.ttl(ctx, loginFailPrefix+k.name))
+		}
+		wait = max(wait, g.ttl(ctx, loginWaitPrefix+k.name))
+	}
+	return wait
+}
+
+func (g *LoginGuard) ttl(ctx context.Context, key string) time.Duration {
+	d, err := g.rdb.PTTL(ctx, key).Result()
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// 失敗を記録し、次の試行までの待ち時間を設定する
+func (g *LoginGuard) Fail(ctx context.Context, username, ip string) {
+	for _, k := range g.keys(username, ip) {
+		n, err := g.rdb.Incr(ctx, loginFailPrefix+k.name).Result()
+		if err != nil {
+			log.Println("ログイン失敗回数の記録失敗:", err)
+			return
+		}
+		g.rdb.Expire(ctx, loginFailPrefix+k.name, g.cfg.LockoutDuration)
+
+		if delay := g.backoff(int(n)); delay > 0 {
+			g.rdb.Set(ctx, loginWaitPrefix+k.name, strconv.FormatInt(n, 10), delay)
+		}
+	}
+}
+
+// free_attempts を超えた分だけ backoff_base を倍にしていく
+func (g *LoginGuard) backoff(failures int) time.Duration {
+	over := failures - g.cfg.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	delay := g.cfg.BackoffBase
+	for i := 1; i < over && delay < g.cfg.BackoffMax; i++ {
+		delay *= 2
+	}
+	return min(delay, g.cfg.BackoffMax)
+}
+
+// 成功したらユーザー名の失敗回数を消す（IP側は同じIPからの別アカウントへの総当たりがあるので残す）
+func (g *LoginGuard) Succeed(ctx context.Context, username string) {
+	g.rdb.Del(ctx, loginFailPrefix+"user:"+username, loginWaitPrefix+"user:"+username)
+}
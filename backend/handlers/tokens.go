@@ -0,0 +1,170 @@
+// アクセストークンとリフレッシュトークン
+// リフレッシュトークンのファミリー（= ログイン1回分のセッション、sessions.go）ごとに交換履歴を持つ
+package handlers
+
+import (
+	"backend/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ログイン・リフレッシュのレスポンス
+type TokenResponse struct {
+	Token        string `json:"token"` // アクセストークン
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // アクセストークンの残り秒数
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+var errInvalidRefreshToken = errors.New("リフレッシュトークンが無効です")
+
+// familyID のファミリーに新しいリフレッシュトークンを追加し、アクセストークンと一緒に返す
+func issueTokens(ctx context.Context, tx pgx.Tx, tokens *utils.TokenManager, userID int, username, familyID string) (TokenResponse, error) {
+	var res TokenResponse
+
+	refresh, hash, err := utils.NewRefreshToken()
+	if err != nil {
+		return res, err
+	}
+	expiresAt := time.Now().Add(tokens.RefreshTTL())
+	_, err = tx.Exec(ctx,
+		`INSERT INTO refresh_tokens (family_id, user_id, token_hash, expires_at)
+		 VALUES ($1, $2, $3, $4)`,
+		familyID, userID, hash, expiresAt)
+	if err != nil {
+		return res, err
+	}
+
+	access, jti, err := tokens.GenerateJWT(userID, username, familyID)
+	if err != nil {
+		return res, err
+	}
+	_, err = tx.Exec(ctx,
+		`UPDATE sessions SET last_jti = $2, last_seen_at = now(), expires_at = $3 WHERE id = $1`,
+		familyID, jti, expiresAt)
+	if err != nil {
+		return res, err
+	}
+
+	res.Token = access
+	res.RefreshToken = refresh
+	res.ExpiresIn = int(tokens.AccessTTL().Seconds())
+	return res, nil
+}
+
+// ログイン時に新しいセッション（ファミリー）を作ってトークンを発行する
+func startSession(ctx context.Context, db *pgxpool.Pool, tokens *utils.TokenManager, userID int, username, userAgent, ip string) (TokenResponse, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	sessionID := uuid.New().String()
+	_, err = tx.Exec(ctx,
+		`INSERT INTO sessions (id, user_id, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, now())`,
+		sessionID, userID, userAgent, ip)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	res, err := issueTokens(ctx, tx, tokens, userID, username, sessionID)
+	if err != nil {
+		return res, err
+	}
+	return res, tx.Commit(ctx)
+}
+
+// リフレッシュトークンを新しいものに交換する
+// 交換済みのトークンが使われたら再利用とみなし、ファミリーごと失効させる
+func rotateRefreshToken(ctx context.Context, db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, refresh string) (TokenResponse, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		id                   int
+		familyID, username   string
+		userID               int
+		expiresAt            time.Time
+		rotatedAt, revokedAt *time.Time
+	)
+	err = tx.QueryRow(ctx,
+		`SELECT t.id, t.family_id::text, t.user_id, u.username, t.expires_at, t.rotated_at, t.revoked_at
+		 FROM refresh_tokens t
+		 JOIN users u ON u.id = t.user_id
+		 WHERE t.token_hash = $1
+		 FOR UPDATE OF t`,
+		utils.HashRefreshToken(refresh),
+	).Scan(&id, &familyID, &userID, &username, &expiresAt, &rotatedAt, &revokedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TokenResponse{}, errInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	if revokedAt != nil || time.Now().After(expiresAt) {
+		return TokenResponse{}, errInvalidRefreshToken
+	}
+	if rotatedAt != nil {
+		tx.Rollback(ctx)
+		log.Printf("リフレッシュトークンの再利用を検出: user=%s family=%s", username, familyID)
+		if err := revokeSession(ctx, db, tokens, hub, familyID); err != nil {
+			return TokenResponse{}, err
+		}
+		return TokenResponse{}, errInvalidRefreshToken
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_tokens SET rotated_at = now() WHERE id = $1`, id); err != nil {
+		return TokenResponse{}, err
+	}
+	res, err := issueTokens(ctx, tx, tokens, userID, username, familyID)
+	if err != nil {
+		return res, err
+	}
+	return res, tx.Commit(ctx)
+}
+
+// POST /token/refresh {"refresh_token": "..."}
+func RefreshTokenHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req refreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+			http.Error(w, "無効なリクエスト", http.StatusBadRequest)
+			return
+		}
+
+		res, err := rotateRefreshToken(r.Context(), db, tokens, hub, req.RefreshToken)
+		if errors.Is(err, errInvalidRefreshToken) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Println("トークン更新失敗:", err)
+			http.Error(w, "トークン更新失敗", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
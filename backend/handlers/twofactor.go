@@ -0,0 +1,432 @@
+// TOTP による2段階認証
+// パスワードが合っていても2段階認証が有効なら、ログインは短命の事前認証トークンを返すだけにして
+// /login/2fa でコード（またはリカバリーコード）を確認してからセッションを発行する
+package handlers
+
+import (
+	"backend/utils"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	totpIssuer          = "ChatApp"
+	preAuthTTL          = 5 * time.Minute
+	preAuthPrefix       = "preauth:"
+	maxPreAuthAttempts  = 5
+	recoveryCodeCount   = 10
+	recoveryCodeEntropy = 10 // バイト。Base32で16文字
+)
+
+// 事前認証トークンに紐づけて Redis に置く中身
+type preAuth struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Attempts int    `json:"attempts"`
+}
+
+// ログインの1段目で2段階認証が必要な場合のレスポンス
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	PreAuthToken      string `json:"pre_auth_token"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+func preAuthKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return preAuthPrefix + hex.EncodeToString(sum[:])
+}
+
+func totpEnabled(ctx context.Context, db *pgxpool.Pool, userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)`,
+		userID,
+	).Scan(&enabled)
+	return enabled, err
+}
+
+// パスワード確認済みのユーザーに事前認証トークンを発行する
+func beginPreAuth(ctx context.Context, rdb *redis.Client, userID int, username string) (TwoFactorChallenge, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return TwoFactorChallenge{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	data, _ := json.Marshal(preAuth{UserID: userID, Username: username})
+	if err := rdb.Set(ctx, preAuthKey(token), data, preAuthTTL).Err(); err != nil {
+		return TwoFactorChallenge{}, err
+	}
+	return TwoFactorChallenge{
+		TwoFactorRequired: true,
+		PreAuthToken:      token,
+		ExpiresIn:         int(preAuthTTL.Seconds()),
+	}, nil
+}
+
+// 秘密鍵は行の持ち主と結び付けて暗号化する（別のユーザーの行に移しても復号できない）
+func totpSecretAAD(userID int) []byte {
+	return []byte("user_totp:" + strconv.Itoa(userID))
+}
+
+// TOTPコードを確認する。同じコード（タイムステップ）の再利用は拒否する
+func verifyUserTOTP(ctx context.Context, db *pgxpool.Pool, tokens *utils.TokenManager, userID int, code string, requireEnabled bool) (bool, error) {
+	var sealed []byte
+	var lastStep int64
+	var enabledAt *time.Time
+	err := db.QueryRow(ctx,
+		`SELECT secret, last_used_step, enabled_at FROM user_totp WHERE user_id = $1`, userID,
+	).Scan(&sealed, &lastStep, &enabledAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if requireEnabled && enabledAt == nil {
+		return false, nil
+	}
+
+	secret, err := tokens.Open(sealed, totpSecretAAD(userID))
+	if err != nil {
+		return false, err
+	}
+	step, ok := utils.VerifyTOTP(string(secret), code, time.Now())
+	if !ok || step <= lastStep {
+		return false, nil
+	}
+	tag, err := db.Exec(ctx,
+		`UPDATE user_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2`,
+		userID, step)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// 区切りや大文字小文字の違いを無視して比較できるようにする
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// 未使用のリカバリーコードなら使用済みにして true を返す
+func useRecoveryCode(ctx context.Context, db *pgxpool.Pool, userID int, code string) (bool, error) {
+	tag, err := db.Exec(ctx,
+		`UPDATE recovery_codes SET used_at = now()
+		 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// リカバリーコードを作り直す。平文はこのときだけ返す
+func regenerateRecoveryCodes(ctx context.Context, tx pgx.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		b := make([]byte, recoveryCodeEntropy)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(enc.EncodeToString(b))
+		code := s[:8] + "-" + s[8:]
+		_, err := tx.Exec(ctx,
+			`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// POST /login/2fa {"pre_auth_token": "...", "code": "123456"} または {"pre_auth_token": "...", "recovery_code": "..."}
+func TwoFactorLoginHandler(db *pgxpool.Pool, tokens *utils.TokenManager, rdb *redis.Client, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req struct {
+			PreAuthToken string `json:"pre_auth_token"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PreAuthToken == "" {
+			http.Error(w, "無効なリクエスト", http.StatusBadRequest)
+			return
+		}
+
+		key := preAuthKey(req.PreAuthToken)
+		data, err := rdb.Get(r.Context(), key).Bytes()
+		if err != nil {
+			http.Error(w, "認証の有効期限が切れました。もう一度ログインしてください", http.StatusUnauthorized)
+			return
+		}
+		var pa preAuth
+		if err := json.Unmarshal(data, &pa); err != nil {
+			http.Error(w, "認証の有効期限が切れました。もう一度ログインしてください", http.StatusUnauthorized)
+			return
+		}
+		// パスワードでのログインと同じ制限をコードの試行にもかける
+		if wait := guard.RetryAfter(r.Context(), pa.Username, clientIP(r)); wait > 0 {
+			recordLoginFailure(db, r, pa.Username, pa.UserID, "throttled")
+			writeThrottled(w, wait)
+			return
+		}
+
+		var ok bool
+		switch {
+		case req.Code != "":
+			ok, err = verifyUserTOTP(r.Context(), db, tokens, pa.UserID, req.Code, true)
+		case req.RecoveryCode != "":
+			ok, err = useRecoveryCode(r.Context(), db, pa.UserID, req.RecoveryCode)
+		default:
+			http.Error(w, "code か recovery_code を指定してください", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("2段階認証の確認失敗:", err)
+			http.Error(w, "サーバーエラー", http.StatusInternalServerError)
+			return
+		}
+
+		if !ok {
+			log.Println("2段階認証コード不一致:", pa.Username)
+			guard.Fail(r.Context(), pa.Username, clientIP(r))
+			recordLoginFailure(db, r, pa.Username, pa.UserID, "bad_second_factor")
+
+			// 同じ事前認証トークンで試せる回数は限る
+			pa.Attempts++
+			if pa.Attempts >= maxPreAuthAttempts {
+				rdb.Del(r.Context(), key)
+			} else {
+				data, _ := json.Marshal(pa)
+				rdb.Set(r.Context(), key, data, redis.KeepTTL)
+			}
+			http.Error(w, "認証コードが間違っています", http.StatusUnauthorized)
+			return
+		}
+
+		// 1回使ったら終わり。同時に2回通らないよう削除できた方だけ続ける
+		if n, err := rdb.Del(r.Context(), key).Result(); err != nil || n == 0 {
+			http.Error(w, "認証の有効期限が切れました。もう一度ログインしてください", http.StatusUnauthorized)
+			return
+		}
+		if req.RecoveryCode != "" {
+			log.Println("リカバリーコードでログイン:", pa.Username)
+		}
+
+		res, err := startSession(r.Context(), db, tokens, pa.UserID, pa.Username, r.UserAgent(), clientIP(r))
+		if err != nil {
+			log.Printf("トークン生成失敗:%+v\n", err)
+			http.Error(w, "トークン生成失敗", http.StatusInternalServerError)
+			return
+		}
+		guard.Succeed(r.Context(), pa.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// GET  /2fa          有効かどうかと残りのリカバリーコード数
+// POST /2fa/setup    秘密鍵を作って otpauth:// URI を返す（confirm するまで無効のまま）
+// POST /2fa/confirm  {"code"} 認証アプリのコードを確認して有効にし、リカバリーコードを返す
+// POST /2fa/disable  {"password"} パスワードを再入力して無効にする
+func TwoFactorHandler(db *pgxpool.Pool, tokens *utils.TokenManager, guard *LoginGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := tokens.ParseJWTFromRequest(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+
+		action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/2fa"), "/")
+		switch {
+		case action == "" && r.Method == http.MethodGet:
+			var enabled bool
+			var remaining int
+			err := db.QueryRow(r.Context(),
+				`SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL),
+				        (SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL)`,
+				userID,
+			).Scan(&enabled, &remaining)
+			if err != nil {
+				log.Println("2段階認証の状態取得失敗:", err)
+				http.Error(w, "サーバーエラー", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"enabled":                  enabled,
+				"recovery_codes_remaining": remaining,
+			})
+
+		case action == "setup" && r.Method == http.MethodPost:
+			secret, err := utils.GenerateTOTPSecret()
+			if err != nil {
+				http.Error(w, "サーバーエラー", http.StatusInternalServerError)
+				return
+			}
+			sealed, err := tokens.Seal([]byte(secret), totpSecretAAD(userID))
+			if err != nil {
+				log.Println("秘密鍵の暗号化失敗:", err)
+				http.Error(w, "サーバーエラー", http.StatusInternalServerError)
+				return
+			}
+			// 有効になっている場合は上書きしない
+			tag, err := db.Exec(r.Context(),
+				`INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+				 ON CONFLICT (user_id) DO UPDATE
+				 SET secret = EXCLUDED.secret, last_used_step = 0, created_at = now()
+				 WHERE user_totp.enabled_at IS NULL`,
+				userID, sealed)
+			if err != nil {
+				log.Println("2段階認証の登録失敗:", err)
+				http.Error(w, "サーバーエラー", http.StatusInternalServerError)
+				return
+			}
+			if tag.RowsAffected() == 0 {
+				http.Error(w, "2段階認証は既に有効です", http.StatusConflict)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{
+				"secret":           secret,
+				"provisioning_uri": utils.TOTPProvisioningURI(totpIssuer, username, secret),
+			})
+
+		case action == "confirm" && r.Method == http.MethodPost:
+			var req struct {
+				Code string `json:"code"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "無効なリクエスト", http.StatusBadRequest)
+				return
+			}
+			codes, err := confirmTOTP(r.Context(), db, tokens, userID, req.Code)
+			if errors.Is(err, errBadTOTPCode) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if errors.Is(err, errTOTPAlreadyEnabled) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				log.Println("2段階認証の有効化失敗:", err)
+				http.Error(w, "サーバーエラー", http.StatusInternalServerError)
+				return
+			}
+			log.Println("2段階認証を有効化:", username)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+
+		case action == "disable" && r.Method == http.MethodPost:
+			var req struct {
+				Password string `json:"password"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "無効なリクエスト", http.StatusBadRequest)
+				return
+			}
+			// パスワードの総当たりに使われないよう、ログインと同じ制限をかける
+			if wait := guard.RetryAfter(r.Context(), username, clientIP(r)); wait > 0 {
+				recordLoginFailure(db, r, username, userID, "throttled")
+				writeThrottled(w, wait)
+				return
+			}
+			var hash string
+			err := db.QueryRow(r.Context(), `SELECT password_hash FROM users WHERE id = $1`, userID).Scan(&hash)
+			if err != nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+				guard.Fail(r.Context(), username, clientIP(r))
+				recordLoginFailure(db, r, username, userID, "bad_password")
+				http.Error(w, "パスワードが間違っています", http.StatusForbidden)
+				return
+			}
+			guard.Succeed(r.Context(), username)
+			if _, err := db.Exec(r.Context(), `DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+				log.Println("2段階認証の無効化失敗:", err)
+				http.Error(w, "サーバーエラー", http.StatusInternalServerError)
+				return
+			}
+			if _, err := db.Exec(r.Context(), `DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+				log.Println("リカバリーコード削除失敗:", err)
+			}
+			log.Println("2段階認証を無効化:", username)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+	}
+}
+
+var (
+	errBadTOTPCode        = errors.New("認証コードが間違っています")
+	errTOTPAlreadyEnabled = errors.New("2段階認証は既に有効です")
+)
+
+// 登録途中の秘密鍵でコードを確認して有効にし、リカバリーコードを発行する
+func confirmTOTP(ctx context.Context, db *pgxpool.Pool, tokens *utils.TokenManager, userID int, code string) ([]string, error) {
+	ok, err := verifyUserTOTP(ctx, db, tokens, userID, code, false)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errBadTOTPCode
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE user_totp SET enabled_at = now() WHERE user_id = $1 AND enabled_at IS NULL`, userID)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, errTOTPAlreadyEnabled
+	}
+	codes, err := regenerateRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(ctx)
+}
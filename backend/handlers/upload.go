@@ -1,11 +1,17 @@
 package handlers
 
 import (
+	"backend/config"
 	"backend/utils"
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"log"
 	"net/http"
@@ -25,10 +31,10 @@ func randomString(n int) string {
 	return hex.EncodeToString(b)
 }
 
-func UploadHandler(db *pgxpool.Pool) http.HandlerFunc {
+func UploadHandler(db *pgxpool.Pool, tokens *utils.TokenManager, cfg config.UploadsConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// 認証（トークンが有効かチェック）
-		username, err := utils.ParseJWTFromRequest(r)
+		username, err := tokens.ParseJWTFromRequest(r)
 		if err != nil {
 			log.Println("JWT認証エラー:", err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -36,8 +42,15 @@ func UploadHandler(db *pgxpool.Pool) http.HandlerFunc {
 		}
 		log.Println("アップロードユーザー:", username)
 
+		userID, err := userIDByName(r.Context(), db, username)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
 		// multipart/form-data をパース
-		err = r.ParseMultipartForm(10 << 20) // 最大10MB
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxBytes)
+		err = r.ParseMultipartForm(cfg.MaxBytes)
 		if err != nil {
 			http.Error(w, "ファイルサイズが大きすぎます", http.StatusBadRequest)
 			return
@@ -51,7 +64,7 @@ func UploadHandler(db *pgxpool.Pool) http.HandlerFunc {
 		defer file.Close()
 
 		// 保存先ディレクトリ作成（なければ）
-		saveDir := "./uploads"
+		saveDir := cfg.Dir
 		if err := os.MkdirAll(saveDir, os.ModePerm); err != nil {
 			log.Println("フォルダ作成失敗:", err)
 			http.Error(w, "サーバー内部エラー", http.StatusInternalServerError)
@@ -74,20 +87,67 @@ func UploadHandler(db *pgxpool.Pool) http.HandlerFunc {
 		}
 		defer dst.Close()
 
-		if _, err := io.Copy(dst, file); err != nil {
+		// 先頭512バイトでMIMEタイプを判定しつつ保存
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		head = head[:n]
+		size, err := io.Copy(dst, io.MultiReader(bytes.NewReader(head), file))
+		if err != nil {
 			log.Println("ファイル保存失敗:", err)
 			http.Error(w, "コピーに失敗しました", http.StatusInternalServerError)
 			return
 		}
 
-		// 成功レスポンス
+		// 成功レスポンス（送信時に attachments としてそのまま渡せる形）
 		fileURL := fmt.Sprintf("/uploads/%s", uniqueName)
+		att := Attachment{
+			URL:              fileURL,
+			MimeType:         http.DetectContentType(head),
+			Size:             size,
+			OriginalFilename: handler.Filename,
+		}
+		if strings.HasPrefix(att.MimeType, "image/") {
+			if f, err := os.Open(savePath); err == nil {
+				if ic, _, err := image.DecodeConfig(f); err == nil {
+					att.Width, att.Height = ic.Width, ic.Height
+				}
+				f.Close()
+			}
+		}
+
+		// 送信時に添付のメタデータと持ち主をここから引く
+		_, err = db.Exec(r.Context(),
+			`INSERT INTO uploads (file_url, user_id, mime_type, size_bytes, width, height, original_filename)
+			 VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, 0), $7)`,
+			att.URL, userID, att.MimeType, att.Size, att.Width, att.Height, att.OriginalFilename)
+		if err != nil {
+			log.Println("アップロード記録失敗:", err)
+			os.Remove(savePath)
+			http.Error(w, "保存に失敗しました", http.StatusInternalServerError)
+			return
+		}
 		log.Printf("アップロード完了: %s", fileURL)
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"file_url": fileURL,
-		})
+		json.NewEncoder(w).Encode(struct {
+			FileURL string `json:"file_url"`
+			Attachment
+		}{fileURL, att})
+	}
+}
+
+// /upload で保存した画像ファイルか（ルームのアイコンなど、画像しか受け付けない所で使う）
+func isImageUpload(dir, url string) bool {
+	if !isUploadURL(url) {
+		return false
+	}
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(url, "/uploads/"))))
+	if err != nil {
+		return false
 	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	return strings.HasPrefix(http.DetectContentType(head[:n]), "image/")
 }
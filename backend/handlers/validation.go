@@ -0,0 +1,155 @@
+// サインアップ時のユーザー名・パスワードの検証
+package handlers
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 20
+	minPasswordLength = 8
+	maxPasswordBytes  = 72 // bcrypt はこれより後ろを無視する
+)
+
+// @メンション（mentionPattern）でそのまま拾える文字だけにする
+var usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}_\-]+$`)
+
+// 機能や画面の表示と紛らわしい名前（usernameKey で比較する）
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "root": true, "system": true,
+	"support": true, "staff": true, "moderator": true, "official": true,
+	"everyone": true, "here": true, "channel": true, "all": true,
+	"me": true, "you": true, "null": true, "undefined": true, "api": true,
+	"運営": true, "管理者": true, "システム": true, "全員": true,
+}
+
+//go:embed data/common_passwords.txt
+var commonPasswordsFile string
+
+// 推測されやすいパスワード。初回の検証時に読み込む
+var commonPasswords = sync.OnceValue(func() map[string]bool {
+	set := make(map[string]bool)
+	sc := bufio.NewScanner(strings.NewReader(commonPasswordsFile))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[strings.ToLower(line)] = true
+	}
+	return set
+})
+
+// 項目ごとのエラー
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func writeFieldErrors(w http.ResponseWriter, status int, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ValidationErrors{Errors: errs})
+}
+
+// 保存・表示に使う形。全角英数字や合成済みでない文字を揃える
+func normalizeUsername(username string) string {
+	return norm.NFKC.String(username)
+}
+
+// 重複と予約名の判定に使う形。大文字・小文字の違いも区別しない
+func usernameKey(username string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(username)))
+}
+
+// 日本語の名前で混ざるのが普通な文字種。これ以外の組み合わせ（ラテン文字とキリル文字など）は見た目の紛らわしい名前とみなす
+var compatibleScripts = map[string]bool{"Latin": true, "Han": true, "Hiragana": true, "Katakana": true}
+
+func mixedScript(username string) bool {
+	seen := make(map[string]bool)
+	for _, r := range username {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for name, table := range unicode.Scripts {
+			if name != "Common" && name != "Inherited" && unicode.Is(table, r) {
+				seen[name] = true
+				break
+			}
+		}
+	}
+	if len(seen) <= 1 {
+		return false
+	}
+	for name := range seen {
+		if !compatibleScripts[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// username は normalizeUsername 済みのものを渡す
+func validateUsername(username string) []FieldError {
+	var errs []FieldError
+	add := func(code, message string) {
+		errs = append(errs, FieldError{Field: "username", Code: code, Message: message})
+	}
+
+	n := utf8.RuneCountInString(username)
+	switch {
+	case n < minUsernameLength:
+		add("too_short", "ユーザー名は3文字以上にしてください")
+	case n > maxUsernameLength:
+		add("too_long", "ユーザー名は20文字以内にしてください")
+	}
+	if username != "" && !usernamePattern.MatchString(username) {
+		add("invalid_chars", "ユーザー名に使えるのは文字・数字・_・- だけです")
+	}
+	if mixedScript(username) {
+		add("mixed_script", "ユーザー名に紛らわしい文字の組み合わせが含まれています")
+	}
+	if reservedUsernames[usernameKey(username)] {
+		add("reserved", "このユーザー名は使用できません")
+	}
+	return errs
+}
+
+func validatePassword(password, username string) []FieldError {
+	var errs []FieldError
+	add := func(code, message string) {
+		errs = append(errs, FieldError{Field: "password", Code: code, Message: message})
+	}
+
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		add("too_short", "パスワードは8文字以上にしてください")
+	}
+	if len(password) > maxPasswordBytes {
+		add("too_long", "パスワードが長すぎます")
+	}
+	lower := strings.ToLower(password)
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		add("contains_username", "パスワードにユーザー名を含めないでください")
+	}
+	if commonPasswords()[lower] {
+		add("common", "よく使われるパスワードのため使用できません")
+	}
+	return errs
+}
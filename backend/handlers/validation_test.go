@@ -0,0 +1,30 @@
+package handlers
+
+import "testing"
+
+func TestValidateUsernameNormalized(t *testing.T) {
+	cases := []struct {
+		name, username, code string
+	}{
+		{"全角の予約名", "ＡＤＭＩＮ", "reserved"},
+		{"大文字の予約名", "Admin", "reserved"},
+		{"キリル文字の混在", "pаypal", "mixed_script"}, // а は U+0430
+		{"日本語とラテン文字", "田中taro", ""},
+		{"カタカナと長音", "アリス_ー", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var codes []string
+			for _, e := range validateUsername(normalizeUsername(c.username)) {
+				codes = append(codes, e.Code)
+			}
+			if c.code == "" && len(codes) != 0 || c.code != "" && (len(codes) != 1 || codes[0] != c.code) {
+				t.Errorf("codes = %v, want [%s]", codes, c.code)
+			}
+		})
+	}
+
+	if usernameKey("Ａlice") != usernameKey("alice") {
+		t.Error("Ａlice と alice のキーが異なる")
+	}
+}
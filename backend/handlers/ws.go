@@ -3,79 +3,132 @@ package handlers
 import (
 	"backend/utils"
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	"regexp"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // WebSocketで使用する構造体
 type WSMessage struct {
-	Type       string `json:"type"` //"message" or "read"
-	RoomID     int    `json:"room_id"`
-	Text       string `json:"text"`
-	Image      string `json:"image,omitempty"`
-	Sender     int    `json:"sender_id"`
-	Username   string `json:"username"`
-	MessageID  int    `json:"message_id,omitempty"` // 既読通知用
-	HardDelete bool   `json:"hard_delete,omitempty"`
+	Type        string       `json:"type"` //"auth", "message", "read", "leave", "subscribe", "unsubscribe"
+	RoomID      int          `json:"room_id"`
+	Text        string       `json:"text"`
+	Image       string       `json:"image,omitempty"` // 先頭の添付URL（古いクライアント向け）
+	Attachments []Attachment `json:"attachments,omitempty"`
+	StampID     int          `json:"stamp_id,omitempty"`
+	StampURL    string       `json:"stamp_url,omitempty"`
+	Sender      int          `json:"sender_id"`
+	Username    string       `json:"username"`
+	MessageID   int          `json:"message_id,omitempty"` // 既読通知用
+	ParentID    int          `json:"parent_message_id,omitempty"`
+	HardDelete  bool         `json:"hard_delete,omitempty"`
+	CreatedAt   string       `json:"created_at,omitempty"`
+	Kind        string       `json:"kind,omitempty"` // サーバーから送るメッセージの種類（"user" / "system"）
+	SystemEvent *SystemEvent `json:"system_event,omitempty"`
+	Token       string       `json:"token,omitempty"` // auth フレームのアクセストークン
 }
 
-type Client struct {
-	Conn   *websocket.Conn
-	RoomID int
+// トークンを渡すためのサブプロトコル。new WebSocket(url, ["bearer", token]) のように送る
+const bearerSubprotocol = "bearer"
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{bearerSubprotocol},
 }
 
-var (
-	upgrader = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
+// Sec-WebSocket-Protocol の "bearer" の次に並んでいるトークン
+func tokenFromSubprotocol(r *http.Request) string {
+	protocols := websocket.Subprotocols(r)
+	for i, p := range protocols {
+		if p == bearerSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
 	}
+	return ""
+}
 
-	roomClients = make(map[int][]*Client) // ルームごとのクライアントリスト
-	mu          sync.Mutex                // goroutine競合防止
-)
+// サブプロトコルでトークンが来なかった場合は、最初のフレームを {"type":"auth","token":"..."} として待つ
+func readAuthFrame(conn *websocket.Conn, tokens *utils.TokenManager) (*utils.AccessClaims, error) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		return nil, err
+	}
+	if msg.Type != "auth" || msg.Token == "" {
+		return nil, errors.New("最初のフレームが auth ではありません")
+	}
+	return tokens.ParseAccessToken(context.Background(), msg.Token)
+}
 
-// handlers/ws.go の下部
-var RoomClients = roomClients
-var RoomClientsMutex = &mu
+// 理由を付けて接続を閉じる
+func closeWithReason(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+}
 
-func WebSocketHandler(db *pgxpool.Pool) http.HandlerFunc {
+func WebSocketHandler(db *pgxpool.Pool, tokens *utils.TokenManager, hub *Hub, authz *RoomAuthorizer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenStr := r.URL.Query().Get("token")
-		if tokenStr == "" {
-			http.Error(w, "トークンが指定されていません", http.StatusUnauthorized)
-			return
+		// トークンはURLに載せない（アクセスログに残るため）
+		var claims *utils.AccessClaims
+		if tokenStr := tokenFromSubprotocol(r); tokenStr != "" {
+			var err error
+			claims, err = tokens.ParseAccessToken(r.Context(), tokenStr)
+			if err != nil {
+				http.Error(w, "トークンが無効です", http.StatusUnauthorized)
+				return
+			}
 		}
 
-		username, err := utils.ParseJWT(tokenStr)
+		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			http.Error(w, "トークンが無効です", http.StatusUnauthorized)
+			log.Println("WebSocketアップグレード失敗:", err)
 			return
 		}
+		defer conn.Close()
+
+		if claims == nil {
+			claims, err = readAuthFrame(conn, tokens)
+			if err != nil {
+				log.Println("WebSocket認証失敗:", err)
+				closeWithReason(conn, websocket.ClosePolicyViolation, "認証に失敗しました")
+				return
+			}
+		}
+		username := claims.Username
 		log.Printf("WebSocket認証成功: %s", username)
 
-		conn, err := upgrader.Upgrade(w, r, nil)
+		userID, err := userIDByName(context.Background(), db, username)
 		if err != nil {
-			log.Println("WebSocketアップグレード失敗:", err)
+			closeWithReason(conn, websocket.ClosePolicyViolation, "ユーザーが見つかりません")
 			return
 		}
-		defer conn.Close()
 
-		var initMsg WSMessage
-		if err := conn.ReadJSON(&initMsg); err != nil {
-			log.Println("初期メッセージ読み込み失敗:", err)
+		rooms, err := roomIDsForUser(db, userID)
+		if err != nil {
+			log.Println("所属ルーム取得失敗:", err)
+			closeWithReason(conn, websocket.CloseInternalServerErr, "所属ルームの取得に失敗しました")
 			return
 		}
-		client := &Client{Conn: conn, RoomID: initMsg.RoomID}
 
-		mu.Lock()
-		roomClients[client.RoomID] = append(roomClients[client.RoomID], client)
-		mu.Unlock()
+		if claims.SessionID != "" {
+			db.Exec(context.Background(),
+				`UPDATE sessions SET last_seen_at = now() WHERE id = $1`, claims.SessionID)
+		}
+
+		client := newClient(hub, conn, userID, username, claims.SessionID, claims.ExpiresAt, rooms)
+		client.prepareRead()
 
-		log.Printf("ルーム %d にクライアント接続", client.RoomID)
+		hub.register <- client
+		defer func() { hub.unregister <- client }()
+		go client.writePump()
+		client.Send(authenticatedEvent(claims))
 
 		for {
 			var msg WSMessage
@@ -84,147 +137,199 @@ func WebSocketHandler(db *pgxpool.Pool) http.HandlerFunc {
 				break
 			}
 
-			switch msg.Type {
-			case "leave":
-				log.Printf("ユーザー %s がルーム %d を離れました", msg.Username, msg.RoomID)
-				mu.Lock()
-				for _, c := range roomClients[msg.RoomID] {
-					_ = c.Conn.WriteJSON(msg)
+			// 期限が切れる前に新しいトークンを送ってもらい、接続を延長する
+			if msg.Type == "auth" {
+				next, err := tokens.ParseAccessToken(context.Background(), msg.Token)
+				if err != nil || next.Username != username || next.SessionID != claims.SessionID {
+					client.SendError("トークンが無効です")
+					continue
 				}
-				mu.Unlock()
+				claims = next
+				client.Reauthenticate(claims.ExpiresAt)
+				client.Send(authenticatedEvent(claims))
 				continue
+			}
 
-			case "read":
-				log.Printf("既読通知: %s がメッセージ %d を読んだ（ルーム %d）", msg.Username, msg.MessageID, msg.RoomID)
-
-				var readerID int
-				err := db.QueryRow(context.Background(),
-					"SELECT id FROM users WHERE username=$1", msg.Username,
-				).Scan(&readerID)
-				if err == nil {
-					_, err = db.Exec(context.Background(),
-						`INSERT INTO message_reads (message_id, user_id)
-						 VALUES ($1, $2)
-						 ON CONFLICT DO NOTHING`,
-						msg.MessageID, readerID)
-					if err != nil {
-						log.Println("既読情報保存失敗:", err)
-					}
-				} else {
-					log.Println("既読ユーザーID取得失敗:", err)
+			// unsubscribe 以外はルームのメンバーでなければ拒否する
+			if msg.Type != "unsubscribe" {
+				ok, err := authz.IsMember(context.Background(), msg.RoomID, userID)
+				if err != nil {
+					log.Println("メンバー確認失敗:", err)
+					client.SendError("メンバー確認に失敗しました")
+					continue
 				}
-
-				mu.Lock()
-				for _, c := range roomClients[msg.RoomID] {
-					_ = c.Conn.WriteJSON(msg)
+				if !ok {
+					client.SendError("このルームへのアクセス権がありません")
+					continue
 				}
-				mu.Unlock()
-				continue
+			}
 
-			case "delete":
-				log.Printf("削除通知: message_id=%d", msg.MessageID)
+			switch msg.Type {
+			// "join" は1ルーム1接続だった頃のクライアント向けの別名
+			case "subscribe", "join":
+				client.Subscribe(msg.RoomID)
+
+			case "unsubscribe":
+				client.Unsubscribe(msg.RoomID)
 
-				hardDelete := msg.Text == "hard"
+			// 表示をやめただけの通知。グループからの退出は DELETE /rooms/{id}/members/me
+			case "leave":
+				log.Printf("ユーザー %s がルーム %d を離れました", username, msg.RoomID)
+				client.Unsubscribe(msg.RoomID)
+				hub.BroadcastFocused(msg.RoomID, map[string]interface{}{
+					"type":     "leave",
+					"room_id":  msg.RoomID,
+					"user_id":  userID,
+					"username": username,
+				})
 
-				mu.Lock()
-				for _, c := range roomClients[msg.RoomID] {
-					_ = c.Conn.WriteJSON(map[string]interface{}{
-						"type":        "delete",
-						"room_id":     msg.RoomID,
-						"message_id":  msg.MessageID,
-						"hard_delete": hardDelete,
-					})
+			case "read":
+				log.Printf("既読通知: %s がメッセージ %d を読んだ（ルーム %d）", username, msg.MessageID, msg.RoomID)
+
+				// メンバーでなければカーソルの行がないので何も起きない
+				advanced, err := advanceReadCursor(context.Background(), db, msg.RoomID, userID, msg.MessageID)
+				if err != nil {
+					log.Println("既読カーソル更新失敗:", err)
+				}
+				if advanced {
+					broadcastRead(hub, msg.RoomID, userID, username, msg.MessageID)
 				}
-				mu.Unlock()
 
 			case "message":
 				log.Printf("ルーム%d: %s", msg.RoomID, msg.Text)
 
-				var senderID int
-				err := db.QueryRow(context.Background(),
-					"SELECT id FROM users WHERE username = $1", username,
-				).Scan(&senderID)
+				// 古いクライアントはスタンプを image に /stamps/… を入れて送ってくる
+				if msg.StampID == 0 && len(msg.Attachments) == 0 && strings.HasPrefix(msg.Image, "/stamps/") {
+					msg.StampID, err = stampIDByURL(context.Background(), db, msg.Image)
+					if err != nil {
+						client.SendError(errInvalidStamp.Error())
+						continue
+					}
+					msg.Image = ""
+				}
+
+				attachments, err := normalizeAttachments(context.Background(), db, userID, msg.Attachments, msg.Image)
+				if errors.Is(err, errInvalidAttachment) {
+					client.SendError(err.Error())
+					continue
+				}
 				if err != nil {
-					log.Println("sender_id取得失敗:", err)
+					log.Println("添付確認失敗:", err)
+					client.SendError("メッセージの保存に失敗しました")
 					continue
 				}
 
-				err = db.QueryRow(context.Background(),
-					`INSERT INTO messages (room_id, sender_id, text, created_at)
-					 VALUES ($1, $2, $3, now()) RETURNING id`,
-					msg.RoomID, senderID, msg.Text,
-				).Scan(&msg.MessageID)
+				_, err = sendMessage(context.Background(), db, hub, newMessage{
+					RoomID:      msg.RoomID,
+					SenderID:    userID,
+					Text:        msg.Text,
+					Attachments: attachments,
+					StampID:     msg.StampID,
+					ParentID:    msg.ParentID,
+				}, username)
+				if errors.Is(err, errInvalidParent) || errors.Is(err, errInvalidStamp) || errors.Is(err, errRoomArchived) {
+					client.SendError(err.Error())
+					continue
+				}
 				if err != nil {
 					log.Println("メッセージ保存失敗:", err)
+					client.SendError("メッセージの保存に失敗しました")
 					continue
 				}
+			}
+		}
 
-				insertMentions(db, msg.MessageID, msg.Text, username)
-
-				if msg.Image != "" {
-					_, err := db.Exec(context.Background(),
-						`INSERT INTO message_attachments (message_id, file_url, created_at)
-			 			VALUES ($1, $2, now())`,
-						msg.MessageID, msg.Image,
-					)
-					if err != nil {
-						log.Println("画像の保存失敗:", err)
-					} else {
-						log.Printf("画像URLをmessage_attachmentsに保存: message_id=%d, url=%s", msg.MessageID, msg.Image)
-					}
-				}
+		log.Println("WebSocket切断")
+	}
+}
 
-				msg.Username = username
+func authenticatedEvent(claims *utils.AccessClaims) map[string]interface{} {
+	return map[string]interface{}{
+		"type":       "authenticated",
+		"expires_at": claims.ExpiresAt.Format(time.RFC3339),
+	}
+}
 
-				mu.Lock()
-				for _, c := range roomClients[msg.RoomID] {
-					_ = c.Conn.WriteJSON(msg)
-				}
-				mu.Unlock()
-			}
-		}
+// ユーザーが所属する全ルームのID
+func roomIDsForUser(db *pgxpool.Pool, userID int) ([]int, error) {
+	rows, err := db.Query(context.Background(),
+		"SELECT room_id FROM room_members WHERE user_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		mu.Lock()
-		clients := roomClients[client.RoomID]
-		for i, c := range clients {
-			if c == client {
-				roomClients[client.RoomID] = append(clients[:i], clients[i+1:]...)
-				break
-			}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
 		}
-		mu.Unlock()
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
 
-		log.Println("WebSocket切断")
+// メンションされたユーザーの全接続に通知する（表示中でないルームでもサイドバーに出せるように）
+func notifyMentions(hub *Hub, targetIDs []int, msg WSMessage) {
+	for _, id := range targetIDs {
+		hub.SendToUser(id, map[string]interface{}{
+			"type":        "mention",
+			"room_id":     msg.RoomID,
+			"message_id":  msg.MessageID,
+			"text":        msg.Text,
+			"sender_name": msg.Username,
+		})
 	}
 }
 
-func insertMentions(db *pgxpool.Pool, messageID int, messageText string, senderUsername string) {
-	re := regexp.MustCompile(`@([\p{L}\p{N}_\-\p{Han}\p{Hiragana}\p{Katakana}ー一-龯ぁ-んァ-ン]+)`)
-	matches := re.FindAllStringSubmatch(messageText, -1)
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{N}_\-\p{Han}\p{Hiragana}\p{Katakana}ー一-龯ぁ-んァ-ン]+)`)
 
-	for _, match := range matches {
+// 本文中の @ユーザー名 を取り出す
+func mentionedUsernames(messageText string) []string {
+	names := []string{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(messageText, -1) {
 		if len(match) < 2 {
 			continue
 		}
-		username := match[1]
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// メンションを保存し、新たにメンションされたユーザーのIDを返す
+// ルームのメンバー以外の @名前 は無視する（本文が外に漏れないように）
+func insertMentions(db *pgxpool.Pool, roomID, messageID int, messageText string, senderUsername string) []int {
+	var targets []int
 
+	for _, username := range mentionedUsernames(messageText) {
 		if username == senderUsername {
 			log.Printf("自己メンション検出、スキップ: %s", username)
 			continue
 		}
 		var targetUserID int
 		err := db.QueryRow(context.Background(),
-			"SELECT id FROM users WHERE username = $1", username).Scan(&targetUserID)
+			`SELECT u.id FROM users u
+			 JOIN room_members rm ON rm.user_id = u.id AND rm.room_id = $2
+			 WHERE u.username = $1`, username, roomID).Scan(&targetUserID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
 		if err != nil {
 			log.Println("ユーザー名からID取得失敗:", username, err)
 			continue
 		}
 
-		_, err = db.Exec(context.Background(),
-			"INSERT INTO mentions (message_id, mention_target_id) VALUES ($1, $2)",
+		tag, err := db.Exec(context.Background(),
+			"INSERT INTO mentions (message_id, mention_target_id) VALUES ($1, $2) ON CONFLICT DO NOTHING",
 			messageID, targetUserID)
 		if err != nil {
 			log.Println("mentions テーブルへのINSERT失敗:", err)
+			continue
+		}
+		if tag.RowsAffected() > 0 {
+			targets = append(targets, targetUserID)
 		}
 	}
+	return targets
 }
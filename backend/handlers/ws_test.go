@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// REST の送信でもメンションを保存する。ルームにいないユーザーへのメンションは保存も通知もしない
+func TestSendMessageRecordsMentions(t *testing.T) {
+	e := newTestEnv(t)
+	alice, aliceToken := e.user(t, "alice")
+	bob, _ := e.user(t, "bob")
+	e.user(t, "mallory")
+	roomID := e.group(t, "mentions", alice, bob)
+
+	h := SendMessageHandler(e.db, e.tokens, e.hub, e.authz)
+	req := SendMessageRequest{RoomID: roomID, Text: "@bob @mallory @alice"}
+	if rec := serve(t, h, http.MethodPost, "/send", aliceToken, req); rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want 201 (%s)", rec.Code, rec.Body.String())
+	}
+
+	var targets []int
+	rows, err := e.db.Query(context.Background(), `SELECT mention_target_id FROM mentions`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, id)
+	}
+	if len(targets) != 1 || targets[0] != bob {
+		t.Errorf("mentions = %v, want [%d]", targets, bob)
+	}
+}
@@ -0,0 +1,63 @@
+// マイグレーション用サブコマンド
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"backend/migrations"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const migrateUsage = "使い方: migrate up | down [件数] | status"
+
+// go run . migrate up|down [n]|status
+func runMigrate(ctx context.Context, db *pgxpool.Pool, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := migrations.Up(ctx, db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d 件のマイグレーションを適用しました\n", n)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			v, err := strconv.Atoi(args[1])
+			if err != nil || v < 1 {
+				return fmt.Errorf("件数が不正です: %s", args[1])
+			}
+			steps = v
+		}
+		n, err := migrations.Down(ctx, db, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d 件のマイグレーションを巻き戻しました\n", n)
+
+	case "status":
+		list, err := migrations.List(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, s := range list {
+			applied := "未適用"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-40s %s\n", s.Version, s.Name, applied)
+		}
+
+	default:
+		return errors.New(migrateUsage)
+	}
+	return nil
+}
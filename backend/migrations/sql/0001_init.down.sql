@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS mentions;
+DROP TABLE IF EXISTS message_attachments;
+DROP TABLE IF EXISTS message_reads;
+DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS room_members;
+DROP TABLE IF EXISTS chat_rooms;
+DROP TABLE IF EXISTS users;
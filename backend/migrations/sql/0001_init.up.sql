@@ -0,0 +1,68 @@
+-- 初期スキーマ: handlers/*.go が参照しているテーブル一式
+-- 既存の手作りDBにもそのまま適用できるよう IF NOT EXISTS を付けている
+
+CREATE TABLE IF NOT EXISTS users (
+    id            SERIAL PRIMARY KEY,
+    username      TEXT        NOT NULL,
+    password_hash TEXT        NOT NULL,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT users_username_key UNIQUE (username)
+);
+
+CREATE TABLE IF NOT EXISTS chat_rooms (
+    id         SERIAL PRIMARY KEY,
+    is_group   BOOLEAN     NOT NULL DEFAULT false,
+    room_name  TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS chat_rooms_group_name_idx ON chat_rooms (room_name) WHERE is_group;
+
+CREATE TABLE IF NOT EXISTS room_members (
+    room_id   INTEGER     NOT NULL REFERENCES chat_rooms (id) ON DELETE CASCADE,
+    user_id   INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    joined_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (room_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS room_members_user_id_idx ON room_members (user_id);
+
+CREATE TABLE IF NOT EXISTS messages (
+    id         SERIAL PRIMARY KEY,
+    room_id    INTEGER     NOT NULL REFERENCES chat_rooms (id) ON DELETE CASCADE,
+    sender_id  INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    text       TEXT        NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    deleted    BOOLEAN     NOT NULL DEFAULT false
+);
+
+CREATE INDEX IF NOT EXISTS messages_room_id_created_at_idx ON messages (room_id, created_at);
+CREATE INDEX IF NOT EXISTS messages_sender_id_idx ON messages (sender_id);
+
+CREATE TABLE IF NOT EXISTS message_reads (
+    message_id INTEGER     NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    user_id    INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    read_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT message_reads_message_id_user_id_key UNIQUE (message_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS message_reads_user_id_idx ON message_reads (user_id);
+
+CREATE TABLE IF NOT EXISTS message_attachments (
+    id         SERIAL PRIMARY KEY,
+    message_id INTEGER     NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    file_url   TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS message_attachments_message_id_idx ON message_attachments (message_id);
+
+CREATE TABLE IF NOT EXISTS mentions (
+    id                SERIAL PRIMARY KEY,
+    message_id        INTEGER     NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    mention_target_id INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT mentions_message_id_target_key UNIQUE (message_id, mention_target_id)
+);
+
+CREATE INDEX IF NOT EXISTS mentions_target_id_idx ON mentions (mention_target_id);
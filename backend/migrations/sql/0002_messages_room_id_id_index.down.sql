@@ -0,0 +1 @@
+DROP INDEX IF EXISTS messages_room_id_id_idx;
@@ -0,0 +1,2 @@
+-- /messages のキーセットページング用 (room_id, id)
+CREATE INDEX IF NOT EXISTS messages_room_id_id_idx ON messages (room_id, id);
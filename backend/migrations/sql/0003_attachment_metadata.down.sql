@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS message_attachments_message_id_position_idx;
+CREATE INDEX IF NOT EXISTS message_attachments_message_id_idx ON message_attachments (message_id);
+
+ALTER TABLE message_attachments
+    DROP COLUMN position,
+    DROP COLUMN original_filename,
+    DROP COLUMN height,
+    DROP COLUMN width,
+    DROP COLUMN size_bytes,
+    DROP COLUMN mime_type;
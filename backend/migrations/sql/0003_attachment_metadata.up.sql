@@ -0,0 +1,11 @@
+-- 1メッセージに複数の添付を持たせるためのメタデータと並び順
+ALTER TABLE message_attachments
+    ADD COLUMN mime_type         TEXT,
+    ADD COLUMN size_bytes        BIGINT,
+    ADD COLUMN width             INTEGER,
+    ADD COLUMN height            INTEGER,
+    ADD COLUMN original_filename TEXT,
+    ADD COLUMN position          INTEGER NOT NULL DEFAULT 0;
+
+DROP INDEX IF EXISTS message_attachments_message_id_idx;
+CREATE INDEX message_attachments_message_id_position_idx ON message_attachments (message_id, position);
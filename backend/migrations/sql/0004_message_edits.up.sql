@@ -0,0 +1,12 @@
+-- メッセージ本文の編集と、その前の版の履歴
+ALTER TABLE messages ADD COLUMN edited_at TIMESTAMPTZ;
+
+CREATE TABLE message_edits (
+    id            SERIAL PRIMARY KEY,
+    message_id    INTEGER     NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    editor_id     INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    previous_text TEXT        NOT NULL,
+    edited_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX message_edits_message_id_idx ON message_edits (message_id, edited_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS thread_reads;
+DROP INDEX IF EXISTS messages_parent_message_id_idx;
+ALTER TABLE messages DROP COLUMN IF EXISTS parent_message_id;
@@ -0,0 +1,16 @@
+-- スレッド返信。返信は常にスレッドの先頭メッセージにぶら下げる（入れ子にしない）
+-- 先頭が消えたら返信も消す。返信の付いた先頭を取り消したときは論理削除にとどめる
+ALTER TABLE messages
+    ADD COLUMN parent_message_id INTEGER REFERENCES messages (id) ON DELETE CASCADE;
+
+CREATE INDEX messages_parent_message_id_idx ON messages (parent_message_id, id)
+    WHERE parent_message_id IS NOT NULL;
+
+-- スレッドごとの既読位置
+CREATE TABLE thread_reads (
+    user_id              INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    root_message_id      INTEGER     NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    last_read_message_id INTEGER     NOT NULL,
+    updated_at           TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, root_message_id)
+);
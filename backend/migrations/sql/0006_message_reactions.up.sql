@@ -0,0 +1,8 @@
+-- 絵文字リアクション。同じユーザーが同じ絵文字を2回付けることはできない
+CREATE TABLE message_reactions (
+    message_id INTEGER     NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    user_id    INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    emoji      TEXT        NOT NULL CHECK (octet_length(emoji) BETWEEN 1 AND 64),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
@@ -0,0 +1,10 @@
+-- stamp_id を画像添付に戻してから消す
+INSERT INTO message_attachments (message_id, file_url, mime_type, created_at)
+SELECT m.id, s.file_url, s.mime_type, m.created_at
+FROM messages m
+JOIN stamps s ON s.id = m.stamp_id;
+
+DROP TABLE IF EXISTS stamp_usages;
+ALTER TABLE messages DROP COLUMN IF EXISTS stamp_id;
+DROP TABLE IF EXISTS stamps;
+DROP TABLE IF EXISTS stamp_packs;
@@ -0,0 +1,58 @@
+-- スタンプのカタログ。スタンプはパック単位で追加する
+CREATE TABLE stamp_packs (
+    id          SERIAL PRIMARY KEY,
+    name        TEXT        NOT NULL UNIQUE,
+    description TEXT        NOT NULL DEFAULT '',
+    created_by  INTEGER     REFERENCES users (id) ON DELETE SET NULL,
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE stamps (
+    id         SERIAL PRIMARY KEY,
+    pack_id    INTEGER     NOT NULL REFERENCES stamp_packs (id) ON DELETE CASCADE,
+    name       TEXT        NOT NULL,
+    file_url   TEXT        NOT NULL UNIQUE,
+    mime_type  TEXT        NOT NULL,
+    size_bytes BIGINT,
+    width      INTEGER,
+    height     INTEGER,
+    position   INTEGER     NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (pack_id, name)
+);
+
+CREATE INDEX stamps_pack_id_position_idx ON stamps (pack_id, position);
+
+-- 添付とは別に、スタンプを1つだけ持てる
+ALTER TABLE messages
+    ADD COLUMN stamp_id INTEGER REFERENCES stamps (id) ON DELETE SET NULL;
+
+-- ユーザーごとの最近使ったスタンプ
+CREATE TABLE stamp_usages (
+    user_id   INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    stamp_id  INTEGER     NOT NULL REFERENCES stamps (id) ON DELETE CASCADE,
+    use_count INTEGER     NOT NULL DEFAULT 1,
+    used_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, stamp_id)
+);
+
+CREATE INDEX stamp_usages_user_id_used_at_idx ON stamp_usages (user_id, used_at DESC);
+
+-- backend/stamps/ に置いてある既存の4つをデフォルトパックとして登録する
+WITH pack AS (
+    INSERT INTO stamp_packs (name, description) VALUES ('デフォルト', '標準スタンプ') RETURNING id
+)
+INSERT INTO stamps (pack_id, name, file_url, mime_type, position)
+SELECT pack.id, s.name, '/stamps/' || s.name || '.png', 'image/png', s.position
+FROM pack, (VALUES ('smile', 0), ('angry', 1), ('love', 2), ('laugh', 3)) AS s (name, position);
+
+-- 画像添付として送られていた既存のスタンプを stamp_id に移す
+UPDATE messages m
+SET stamp_id = s.id
+FROM message_attachments a
+JOIN stamps s ON s.file_url = a.file_url
+WHERE a.message_id = m.id;
+
+DELETE FROM message_attachments a
+USING stamps s
+WHERE s.file_url = a.file_url;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS messages_text_trgm_idx;
+-- pg_trgm は他で使っているかもしれないので残す
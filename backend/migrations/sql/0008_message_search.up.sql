@@ -0,0 +1,4 @@
+-- メッセージ検索。日本語は単語に区切れないので、全文検索ではなく pg_trgm の部分一致インデックスを使う
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX messages_text_trgm_idx ON messages USING gin (text gin_trgm_ops);
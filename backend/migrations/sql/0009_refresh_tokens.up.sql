@@ -0,0 +1,15 @@
+-- リフレッシュトークン。使うたびに同じファミリーの新しいトークンに交換する
+-- 交換済みのトークンが再び使われたら漏洩とみなしてファミリーごと失効させる
+CREATE TABLE refresh_tokens (
+    id         SERIAL PRIMARY KEY,
+    family_id  UUID        NOT NULL,
+    user_id    INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT        NOT NULL UNIQUE, -- SHA-256。トークン自体は保存しない
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    rotated_at TIMESTAMPTZ, -- 新しいトークンに交換した時刻
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
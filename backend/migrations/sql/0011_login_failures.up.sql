@@ -0,0 +1,13 @@
+-- 失敗したログインの監査記録
+CREATE TABLE login_failures (
+    id         SERIAL PRIMARY KEY,
+    username   TEXT        NOT NULL, -- 入力されたユーザー名（存在しないこともある）
+    user_id    INTEGER     REFERENCES users (id) ON DELETE SET NULL,
+    ip         TEXT        NOT NULL,
+    user_agent TEXT        NOT NULL DEFAULT '',
+    reason     TEXT        NOT NULL, -- unknown_user, bad_password, throttled
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX login_failures_username_created_at_idx ON login_failures (username, created_at);
+CREATE INDEX login_failures_ip_created_at_idx ON login_failures (ip, created_at);
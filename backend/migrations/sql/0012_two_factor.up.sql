@@ -0,0 +1,18 @@
+-- TOTP による2段階認証。enabled_at が NULL の間は登録途中（コード確認待ち）
+CREATE TABLE user_totp (
+    user_id        INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    secret         BYTEA       NOT NULL, -- jwt.secret から作った鍵で AES-GCM 暗号化したもの
+    enabled_at     TIMESTAMPTZ,
+    last_used_step BIGINT      NOT NULL DEFAULT 0, -- 同じコードを2回使わせないため
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- 認証アプリを失くしたとき用の使い捨てコード。ハッシュだけを保存する
+CREATE TABLE recovery_codes (
+    id         SERIAL PRIMARY KEY,
+    user_id    INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash  TEXT        NOT NULL,
+    used_at    TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (user_id, code_hash)
+);
@@ -0,0 +1,11 @@
+-- アクセストークンの署名鍵（Ed25519）。全インスタンスで共有し、定期的に新しい鍵に切り替える
+CREATE TABLE signing_keys (
+    kid          TEXT PRIMARY KEY,
+    algorithm    TEXT NOT NULL DEFAULT 'EdDSA',
+    public_key   BYTEA NOT NULL,
+    private_key  BYTEA NOT NULL, -- jwt.secret から作った鍵で AES-GCM 暗号化したもの
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    activates_at TIMESTAMPTZ NOT NULL -- この時刻以降に発行するトークンの署名に使う
+);
+
+CREATE INDEX idx_signing_keys_activates_at ON signing_keys (activates_at);
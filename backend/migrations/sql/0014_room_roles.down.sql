@@ -0,0 +1,3 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS system_event, DROP COLUMN IF EXISTS kind;
+DROP INDEX IF EXISTS room_members_owner_idx;
+ALTER TABLE room_members DROP COLUMN IF EXISTS role;
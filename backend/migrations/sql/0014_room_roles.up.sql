@@ -0,0 +1,23 @@
+-- グループのメンバー管理: 役割（owner/admin/member）とシステムメッセージ
+ALTER TABLE room_members
+    ADD COLUMN role TEXT NOT NULL DEFAULT 'member'
+        CHECK (role IN ('owner', 'admin', 'member'));
+
+-- オーナーは1ルーム1人
+CREATE UNIQUE INDEX room_members_owner_idx ON room_members (room_id) WHERE role = 'owner';
+
+-- 既存グループは最初に参加した人（作成者）をオーナーにする
+UPDATE room_members rm SET role = 'owner'
+FROM (
+    SELECT DISTINCT ON (m.room_id) m.room_id, m.user_id
+    FROM room_members m
+    JOIN chat_rooms cr ON cr.id = m.room_id
+    WHERE cr.is_group
+    ORDER BY m.room_id, m.joined_at, m.user_id
+) first
+WHERE rm.room_id = first.room_id AND rm.user_id = first.user_id;
+
+-- 'system' は「XさんがYさんを追加しました」などの自動メッセージ。sender_id は操作した人
+ALTER TABLE messages
+    ADD COLUMN kind TEXT NOT NULL DEFAULT 'user' CHECK (kind IN ('user', 'system')),
+    ADD COLUMN system_event JSONB;
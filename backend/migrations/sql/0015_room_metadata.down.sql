@@ -0,0 +1,6 @@
+ALTER TABLE chat_rooms
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS archived_by,
+    DROP COLUMN IF EXISTS archived_at,
+    DROP COLUMN IF EXISTS icon_url,
+    DROP COLUMN IF EXISTS description;
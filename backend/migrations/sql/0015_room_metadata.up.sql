@@ -0,0 +1,7 @@
+-- ルームの説明・アイコン・アーカイブ
+ALTER TABLE chat_rooms
+    ADD COLUMN description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN icon_url    TEXT,
+    ADD COLUMN archived_at TIMESTAMPTZ, -- NULL でなければ一覧に出さず、送信もできない
+    ADD COLUMN archived_by INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    ADD COLUMN updated_at  TIMESTAMPTZ;
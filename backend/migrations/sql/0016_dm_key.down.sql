@@ -0,0 +1,2 @@
+ALTER TABLE chat_rooms DROP CONSTRAINT IF EXISTS chat_rooms_dm_key_key;
+ALTER TABLE chat_rooms DROP COLUMN IF EXISTS dm_key;
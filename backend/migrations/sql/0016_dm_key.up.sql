@@ -0,0 +1,21 @@
+-- 1対1のルームを2人の組み合わせで一意にする。dm_key は "小さいユーザーID:大きいユーザーID"
+ALTER TABLE chat_rooms ADD COLUMN dm_key TEXT;
+
+-- 既存の DM は組み合わせごとに最も古いルームにだけ付ける
+-- （同時作成で重複していた残りは NULL のまま残し、新しい DM は dm_key のある方に集まる）
+UPDATE chat_rooms cr SET dm_key = pairs.dm_key
+FROM (
+    SELECT DISTINCT ON (dm_key) room_id, dm_key
+    FROM (
+        SELECT rm.room_id, MIN(rm.user_id) || ':' || MAX(rm.user_id) AS dm_key
+        FROM room_members rm
+        JOIN chat_rooms c ON c.id = rm.room_id
+        WHERE NOT c.is_group
+        GROUP BY rm.room_id
+        HAVING COUNT(*) = 2
+    ) x
+    ORDER BY dm_key, room_id
+) pairs
+WHERE cr.id = pairs.room_id;
+
+ALTER TABLE chat_rooms ADD CONSTRAINT chat_rooms_dm_key_key UNIQUE (dm_key);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS message_reads (
+    message_id INTEGER     NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    user_id    INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    read_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT message_reads_message_id_user_id_key UNIQUE (message_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS message_reads_user_id_idx ON message_reads (user_id);
+
+-- カーソルまでの他人の発言を1件ずつ既読に戻す
+INSERT INTO message_reads (message_id, user_id, read_at)
+SELECT m.id, rm.user_id, COALESCE(rm.last_read_at, now())
+FROM room_members rm
+JOIN messages m ON m.room_id = rm.room_id AND m.id <= rm.last_read_message_id
+WHERE m.sender_id <> rm.user_id
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE room_members
+    DROP COLUMN IF EXISTS last_read_at,
+    DROP COLUMN IF EXISTS last_read_message_id;
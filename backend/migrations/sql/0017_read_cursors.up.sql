@@ -0,0 +1,25 @@
+-- 既読をメッセージごとの行から、メンバーごとの「どこまで読んだか」に置き換える
+-- last_read_message_id 以下のメッセージはすべて既読として扱う
+ALTER TABLE room_members
+    ADD COLUMN last_read_message_id INTEGER,
+    ADD COLUMN last_read_at         TIMESTAMPTZ;
+
+-- 既存の既読は、読んだ中で一番新しいメッセージ（自分の発言を含む）までを既読にする
+UPDATE room_members rm SET
+    last_read_message_id = c.last_id,
+    last_read_at = c.read_at
+FROM (
+    SELECT x.room_id, x.user_id, MAX(x.message_id) AS last_id, MAX(x.read_at) AS read_at
+    FROM (
+        SELECT m.room_id, mr.user_id, m.id AS message_id, mr.read_at
+        FROM message_reads mr
+        JOIN messages m ON m.id = mr.message_id
+        UNION ALL
+        SELECT m.room_id, m.sender_id, m.id, m.created_at
+        FROM messages m
+    ) x
+    GROUP BY x.room_id, x.user_id
+) c
+WHERE rm.room_id = c.room_id AND rm.user_id = c.user_id;
+
+DROP TABLE message_reads;
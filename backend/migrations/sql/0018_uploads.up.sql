@@ -0,0 +1,22 @@
+-- /upload で保存したファイルとアップロードした人。添付のメタデータはクライアントの申告ではなくここから取る
+CREATE TABLE uploads (
+    file_url          TEXT        PRIMARY KEY,
+    user_id           INTEGER     NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    mime_type         TEXT        NOT NULL,
+    size_bytes        BIGINT      NOT NULL,
+    width             INTEGER,
+    height            INTEGER,
+    original_filename TEXT        NOT NULL DEFAULT '',
+    created_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX uploads_user_id_idx ON uploads (user_id);
+
+-- 既に添付として送られたファイルは、最初に送った人のアップロードとみなす
+INSERT INTO uploads (file_url, user_id, mime_type, size_bytes, width, height, original_filename, created_at)
+SELECT DISTINCT ON (a.file_url)
+       a.file_url, m.sender_id, COALESCE(a.mime_type, 'application/octet-stream'), COALESCE(a.size_bytes, 0),
+       a.width, a.height, COALESCE(a.original_filename, ''), a.created_at
+FROM message_attachments a
+JOIN messages m ON m.id = a.message_id
+ORDER BY a.file_url, a.id;
@@ -0,0 +1,12 @@
+-- 大文字・小文字や全角・半角の違いだけの名前を別人として登録させない
+-- 新規登録ではアプリ側の usernameKey（NFKC＋ケースフォールディング）を入れる。既存の行は近い形で埋める
+ALTER TABLE users ADD COLUMN username_key TEXT;
+
+UPDATE users SET username_key = lower(normalize(username, NFKC));
+
+-- 既に重複している後発のアカウントは、名前に使えない # を付けて区別しておく
+UPDATE users u SET username_key = u.username_key || '#' || u.id
+WHERE EXISTS (SELECT 1 FROM users o WHERE o.username_key = u.username_key AND o.id < u.id);
+
+ALTER TABLE users ALTER COLUMN username_key SET NOT NULL;
+CREATE UNIQUE INDEX users_username_key_idx ON users (username_key);
@@ -1,93 +1,216 @@
 package utils
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"backend/config"
+
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
 )
 
-// 秘密鍵の定義
-var jwtSecret = []byte("your_secret_key") // 本番環境では環境変数で管理！
+// アクセストークンの発行と検証。署名鍵は DB、失効リストは Redis に置く
+// main で1つ作り、トークンを扱うハンドラーに渡す
+type TokenManager struct {
+	db  *pgxpool.Pool
+	rdb *redis.Client
+
+	secret      []byte // 署名鍵の暗号化用
+	ttl         time.Duration
+	refreshTTL  time.Duration
+	issuer      string
+	audience    string
+	keyRotation time.Duration
+
+	keysMu  sync.RWMutex
+	keyring []signingKey // activatesAt の昇順
+}
+
+func NewTokenManager(cfg config.JWTConfig, db *pgxpool.Pool, rdb *redis.Client) *TokenManager {
+	return &TokenManager{
+		db:          db,
+		rdb:         rdb,
+		secret:      []byte(cfg.Secret),
+		ttl:         cfg.TTL,
+		refreshTTL:  cfg.RefreshTTL,
+		issuer:      cfg.Issuer,
+		audience:    cfg.Audience,
+		keyRotation: cfg.KeyRotation,
+	}
+}
 
-// トークン生成
-func GenerateJWT(username string) (string, error) {
+// 検証済みアクセストークンの中身
+type AccessClaims struct {
+	UserID    int // sub
+	Username  string
+	ID        string    // jti
+	SessionID string    // sid。リフレッシュトークンのファミリーID
+	ExpiresAt time.Time // exp
+}
+
+// アクセストークン生成。sessionID はリフレッシュトークンのファミリーID。トークンと jti を返す
+// 今の署名鍵（Ed25519）で署名し、ヘッダーの kid で検証側が鍵を選べるようにする
+func (t *TokenManager) GenerateJWT(userID int, username, sessionID string) (string, string, error) {
+	key, err := t.currentSigningKey()
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
 	jti := uuid.New().String() //ユニバーサル一意識別子、かぶらないようにいっぱい文字をだすよ
 	claims := jwt.MapClaims{
+		"sub":      strconv.Itoa(userID),
 		"username": username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(), //24時間有効
-		"jti":      jti,                                   //トークンID
+		"iss":      t.issuer,
+		"aud":      t.audience,
+		"iat":      now.Unix(),
+		"exp":      now.Add(t.ttl).Unix(),
+		"jti":      jti, //トークンID
+		"sid":      sessionID,
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(key.private)
+	return signed, jti, err
 }
 
-// リクエストヘッダーからトークンを検証
-func ParseJWTFromRequest(r *http.Request) (string, error) {
+// アクセストークンの有効期限
+func (t *TokenManager) AccessTTL() time.Duration {
+	return t.ttl
+}
+
+// リフレッシュトークンの有効期限
+func (t *TokenManager) RefreshTTL() time.Duration {
+	return t.refreshTTL
+}
+
+// リフレッシュトークンを生成する。DBにはハッシュだけを保存する
+func NewRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authorization: Bearer ... からトークン文字列を取り出す
+func BearerToken(r *http.Request) (string, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return "", errors.New("Authorizationヘッダーがありません")
 	}
-
-	//HTTPヘッダーからAuthorization: Bearer ...を取得
 	parts := strings.Split(authHeader, " ")
 	if len(parts) != 2 || parts[0] != "Bearer" {
 		return "", errors.New("Authorizationヘッダーの形式が不正です")
 	}
+	return parts[1], nil
+}
 
-	//Bearer形式かを確認
-	tokenStr := parts[1]
+// 署名・有効期限・失効（jti とセッション）を確認して中身を返す
+func (t *TokenManager) ParseAccessToken(ctx context.Context, tokenStr string) (*AccessClaims, error) {
 	claims := jwt.MapClaims{}
 	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		key, ok := t.verificationKey(kid)
+		if !ok {
+			return nil, errors.New("署名鍵が見つかりません")
+		}
+		return key, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithIssuer(t.issuer),
+		jwt.WithAudience(t.audience),
+	)
 	if err != nil || !token.Valid {
-		return "", errors.New("トークンが無効です")
+		return nil, errors.New("トークンが無効です")
 	}
 
-	// jti の存在確認
-	jti, ok := claims["jti"].(string)
-	if !ok || jti == "" {
-		return "", errors.New("トークンに jti が含まれていません")
+	var ac AccessClaims
+	sub, err := claims.GetSubject()
+	if err != nil {
+		return nil, errors.New("トークンに sub が含まれていません")
 	}
+	if ac.UserID, err = strconv.Atoi(sub); err != nil || ac.UserID <= 0 {
+		return nil, errors.New("トークンの sub が不正です")
+	}
+	var ok bool
+	if ac.ID, ok = claims["jti"].(string); !ok || ac.ID == "" {
+		return nil, errors.New("トークンに jti が含まれていません")
+	}
+	if ac.Username, ok = claims["username"].(string); !ok || ac.Username == "" {
+		return nil, errors.New("トークンに username が含まれていません")
+	}
+	ac.SessionID, _ = claims["sid"].(string)
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return nil, errors.New("トークンに exp が含まれていません")
+	}
+	ac.ExpiresAt = exp.Time
 
-	// Redis でブラックリスト確認
-	exists, err := RedisClient.Exists(Ctx, "blacklist:"+jti).Result()
+	// Redis でブラックリスト確認（トークン単体とセッション全体）
+	keys := []string{"blacklist:" + ac.ID}
+	if ac.SessionID != "" {
+		keys = append(keys, "revoked_session:"+ac.SessionID)
+	}
+	exists, err := t.rdb.Exists(ctx, keys...).Result()
 	if err != nil {
-		return "", errors.New("Redis 確認中にエラーが発生しました: " + err.Error())
+		return nil, errors.New("Redis 確認中にエラーが発生しました: " + err.Error())
 	}
-	if exists == 1 {
-		return "", errors.New("このトークンは無効化されています")
+	if exists > 0 {
+		return nil, errors.New("このトークンは無効化されています")
 	}
 
-	// username 抽出
-	username, ok := claims["username"].(string)
-	if !ok {
-		return "", errors.New("トークンに username が含まれていません")
-	}
+	return &ac, nil
+}
 
-	return username, nil
+// リクエストヘッダーのトークンを検証して中身を返す
+func (t *TokenManager) ClaimsFromRequest(r *http.Request) (*AccessClaims, error) {
+	tokenStr, err := BearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	return t.ParseAccessToken(r.Context(), tokenStr)
 }
 
-// JWTを検証してユーザー名を取り出す
-func ParseJWT(tokenString string) (string, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil || !token.Valid {
+// リクエストヘッダーからトークンを検証
+func (t *TokenManager) ParseJWTFromRequest(r *http.Request) (string, error) {
+	claims, err := t.ClaimsFromRequest(r)
+	if err != nil {
 		return "", err
 	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		username := claims["username"].(string)
-		return username, nil
+	return claims.Username, nil
+}
+
+// アクセストークン1つを残りの有効期限の間だけ無効にする
+func (t *TokenManager) BlacklistToken(ctx context.Context, claims *AccessClaims) error {
+	ttl := time.Until(claims.ExpiresAt)
+	if ttl <= 0 {
+		return nil
 	}
-	return "", err
+	return t.rdb.Set(ctx, "blacklist:"+claims.ID, "1", ttl).Err()
 }
 
-// テストや外部用に秘密鍵を返す
-func GetJWTSecret() []byte {
-	return jwtSecret
+// セッション（リフレッシュトークンのファミリー）で発行済みのアクセストークンをまとめて無効にする
+// アクセストークンは ttl で切れるので、その間だけ覚えておけばよい
+func (t *TokenManager) RevokeSession(ctx context.Context, sessionID string) error {
+	return t.rdb.Set(ctx, "revoked_session:"+sessionID, "1", t.ttl).Err()
 }
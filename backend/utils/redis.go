@@ -1,17 +1,15 @@
 package utils
 
 import (
-	"context"
+	"backend/config"
 
 	"github.com/redis/go-redis/v9"
 )
 
-var Ctx = context.Background()
-
-var RedisClient *redis.Client
-
-func InitRedis() {
-	RedisClient = redis.NewClient(&redis.Options{
-		Addr: "localhost:6379", // 必要に応じて変更
+func NewRedis(cfg config.RedisConfig) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
 }
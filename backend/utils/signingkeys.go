@@ -0,0 +1,277 @@
+// アクセストークンの署名鍵（Ed25519）の管理
+// 鍵は DB に置いて全インスタンスで共有し、key_rotation ごとに新しい鍵に切り替える。
+// 新しい鍵は使い始める keyPrepublish 前から JWKS に載せ、古い鍵はそれで署名したトークンが切れるまで残す
+package utils
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	keyPrepublish     = time.Hour   // 他のサービスが JWKS を取り直すまでの余裕
+	keyReloadInterval = time.Minute // 他のインスタンスが作った鍵を読み込む間隔
+	signingKeysLock   = 72_690_002  // 鍵の作成を1インスタンスに絞る advisory lock
+)
+
+type signingKey struct {
+	kid         string
+	public      ed25519.PublicKey
+	private     ed25519.PrivateKey
+	activatesAt time.Time
+}
+
+// 起動時に鍵を用意して読み込む
+func (t *TokenManager) InitSigningKeys(ctx context.Context) error {
+	if err := t.rotateSigningKeys(ctx); err != nil {
+		return err
+	}
+	return t.loadSigningKeys(ctx)
+}
+
+// 定期的に鍵の切り替えと読み込みを行う
+func (t *TokenManager) RunKeyRotation(ctx context.Context) {
+	ticker := time.NewTicker(keyReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := t.rotateSigningKeys(ctx); err != nil {
+			log.Println("署名鍵の切り替え失敗:", err)
+		}
+		if err := t.loadSigningKeys(ctx); err != nil {
+			log.Println("署名鍵の読み込み失敗:", err)
+		}
+	}
+}
+
+// 必要なら次の鍵を作り、もう使われない鍵を消す
+func (t *TokenManager) rotateSigningKeys(ctx context.Context) error {
+	tx, err := t.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, signingKeysLock); err != nil {
+		return err
+	}
+
+	var latest *time.Time
+	if err := tx.QueryRow(ctx, `SELECT max(activates_at) FROM signing_keys`).Scan(&latest); err != nil {
+		return err
+	}
+	now := time.Now()
+	switch {
+	case latest == nil:
+		// 最初の鍵はまだ誰もキャッシュしていないのですぐ使う
+		if err := t.insertSigningKey(ctx, tx, now); err != nil {
+			return err
+		}
+	case !now.Before(latest.Add(t.keyRotation - keyPrepublish)):
+		// 止まっていた間に切り替え時刻を過ぎていても、公開してから keyPrepublish は待つ
+		if err := t.insertSigningKey(ctx, tx, maxTime(latest.Add(t.keyRotation), now.Add(keyPrepublish))); err != nil {
+			return err
+		}
+	}
+
+	// 次の鍵に切り替わってからアクセストークンの有効期限以上たった鍵は不要
+	_, err = tx.Exec(ctx,
+		`DELETE FROM signing_keys k
+		 WHERE EXISTS (SELECT 1 FROM signing_keys n WHERE n.activates_at > k.activates_at AND n.activates_at < $1)`,
+		now.Add(-t.ttl-time.Minute))
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (t *TokenManager) insertSigningKey(ctx context.Context, tx pgx.Tx, activatesAt time.Time) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	sealed, err := t.sealPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	kid := keyThumbprint(pub)
+	_, err = tx.Exec(ctx,
+		`INSERT INTO signing_keys (kid, public_key, private_key, activates_at) VALUES ($1, $2, $3, $4)`,
+		kid, []byte(pub), sealed, activatesAt)
+	if err != nil {
+		return err
+	}
+	log.Printf("署名鍵を作成: kid=%s 使用開始=%s", kid, activatesAt.Format(time.RFC3339))
+	return nil
+}
+
+func (t *TokenManager) loadSigningKeys(ctx context.Context) error {
+	rows, err := t.db.Query(ctx,
+		`SELECT kid, public_key, private_key, activates_at FROM signing_keys ORDER BY activates_at`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var keys []signingKey
+	for rows.Next() {
+		var k signingKey
+		var pub, sealed []byte
+		if err := rows.Scan(&k.kid, &pub, &sealed, &k.activatesAt); err != nil {
+			return err
+		}
+		if len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("署名鍵 %s の公開鍵が不正です", k.kid)
+		}
+		k.public = ed25519.PublicKey(pub)
+		if k.private, err = t.openPrivateKey(sealed); err != nil {
+			return fmt.Errorf("署名鍵 %s を復号できません（jwt.secret が変わっていませんか）: %w", k.kid, err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	t.keysMu.Lock()
+	t.keyring = keys
+	t.keysMu.Unlock()
+	return nil
+}
+
+// 今トークンの署名に使う鍵（使用開始済みのうち最新のもの）
+func (t *TokenManager) currentSigningKey() (signingKey, error) {
+	t.keysMu.RLock()
+	defer t.keysMu.RUnlock()
+	now := time.Now()
+	for i := len(t.keyring) - 1; i >= 0; i-- {
+		if !t.keyring[i].activatesAt.After(now) {
+			return t.keyring[i], nil
+		}
+	}
+	return signingKey{}, errors.New("使用できる署名鍵がありません")
+}
+
+func (t *TokenManager) verificationKey(kid string) (ed25519.PublicKey, bool) {
+	t.keysMu.RLock()
+	defer t.keysMu.RUnlock()
+	for _, k := range t.keyring {
+		if k.kid == kid {
+			return k.public, true
+		}
+	}
+	return nil, false
+}
+
+// JWKS（RFC 7517）の1件
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// 検証に使える公開鍵の一覧。使用開始前の鍵も含める
+func (t *TokenManager) JWKS() JWKSet {
+	t.keysMu.RLock()
+	defer t.keysMu.RUnlock()
+	set := JWKSet{Keys: make([]JWK, 0, len(t.keyring))}
+	for i := len(t.keyring) - 1; i >= 0; i-- {
+		k := t.keyring[i]
+		set.Keys = append(set.Keys, JWK{
+			Kty: "OKP",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(k.public),
+			Kid: k.kid,
+			Use: "sig",
+			Alg: "EdDSA",
+		})
+	}
+	return set
+}
+
+// kid は公開鍵の JWK Thumbprint（RFC 7638）
+func keyThumbprint(pub ed25519.PublicKey) string {
+	x := base64.RawURLEncoding.EncodeToString(pub)
+	sum := sha256.Sum256([]byte(`{"crv":"Ed25519","kty":"OKP","x":"` + x + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// 秘密鍵や TOTP の秘密鍵は jwt.secret から作った鍵で暗号化して保存する
+func (t *TokenManager) keyCipher() (cipher.AEAD, error) {
+	sum := sha256.Sum256(t.secret)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal は jwt.secret から作った鍵で plaintext を暗号化する。aad は復号時にも同じものを渡す
+func (t *TokenManager) Seal(plaintext, aad []byte) ([]byte, error) {
+	aead, err := t.keyCipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Open は Seal で暗号化したものを元に戻す
+func (t *TokenManager) Open(sealed, aad []byte) ([]byte, error) {
+	aead, err := t.keyCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("暗号文が短すぎます")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+func (t *TokenManager) sealPrivateKey(priv ed25519.PrivateKey) ([]byte, error) {
+	return t.Seal(priv.Seed(), nil)
+}
+
+func (t *TokenManager) openPrivateKey(sealed []byte) (ed25519.PrivateKey, error) {
+	seed, err := t.Open(sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("秘密鍵の長さが不正です")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -48,6 +48,7 @@ function App() {
       .catch((err) => {
         console.error("JWTからユーザー取得失敗:", err);
         localStorage.removeItem("token");
+        localStorage.removeItem("refresh_token");
         setUsername(null);
         navigate("/");
       });
@@ -56,7 +57,16 @@ function App() {
   //ログアウト処理
   //トークンを削除してログイン画面に戻る
   const handleLogout = () => {
+    const token = localStorage.getItem("token");
+    if (token) {
+      //サーバー側でもトークンを失効させる
+      fetch("http://localhost:8081/logout", {
+        method: "POST",
+        headers: { Authorization: `Bearer ${token}` },
+      }).catch((err) => console.error("ログアウト失敗:", err));
+    }
     localStorage.removeItem("token");
+    localStorage.removeItem("refresh_token");
     setUsername(null);
     navigate("/");
   };
@@ -2,6 +2,7 @@
 import React, { useEffect, useRef, useState } from "react";
 import { useInView } from "react-intersection-observer";
 import { useLocation } from "react-router-dom";
+import { refreshTokens } from "./auth";
 
 
 function MessageItem({ 
@@ -9,10 +10,10 @@ function MessageItem({
   username,
   socketRef,
   roomId,
-  readStatus,
-  setReadStatus,
+  myReadCursor,
+  onRead,
   sendWhenReady,
-  readersByMessageId,
+  readCount,
   scrollRefs,
   onUndo,
   onDelete,
@@ -33,7 +34,8 @@ function MessageItem({
   useEffect(() => {
     if (!msg.id || isMine) return;
 
-    if (readStatus[msg.id] || readRequestedRef.current.has(msg.id)) return;
+    // 既読カーソルより前のメッセージは送り直さない
+    if (myReadCursor >= msg.id || readRequestedRef.current.has(msg.id)) return;
 
     //if (readRequestedRef.current.has(msg.id)) return;
 
@@ -57,12 +59,9 @@ function MessageItem({
         message_id: msg.id,
       });
 
-      setReadStatus((prev) => ({
-        ...prev,
-        [msg.id]: true,
-      }));
+      onRead(msg.id);
     }
-  }, [inView, isMine, msg.id, roomId, username, sendWhenReady, readStatus, setReadStatus, readRequestedRef]);
+  }, [inView, isMine, msg.id, roomId, username, sendWhenReady, myReadCursor, onRead, readRequestedRef]);
 
   return (
     <div
@@ -127,11 +126,11 @@ function MessageItem({
               dateStyle: "short",
               timeStyle: "short",
             })}
-            {isMine && readersByMessageId[msg.id]?.length > 0 && (
+            {isMine && readCount > 0 && (
               <span style={{ marginLeft: "8px", color: "gray" }}>
-                {readersByMessageId[msg.id].length === 1
+                {readCount === 1
                   ? "既読"
-                  : `既読: ${readersByMessageId[msg.id].length}`}
+                  : `既読: ${readCount}`}
               </span>
             )}
           </div>
@@ -177,8 +176,8 @@ function Chat({ roomId, username, onReadReaset }) {
   const [messages, setMessages] = useState([]);
   const [text, setText] = useState("");
   const [roomName, setRoomName] = useState("チャットルーム!");
-  const [readStatus, setReadStatus] = useState({});
-  const [readersByMessageId, setReadersByMessageId] = useState({});
+  // メンバーごとの既読カーソル（username → 最後に読んだメッセージID）
+  const [readCursors, setReadCursors] = useState({});
   const [imageFile, setImageFile] = useState(null);
   
   const location = useLocation();
@@ -196,6 +195,17 @@ function Chat({ roomId, username, onReadReaset }) {
     "/stamps/laugh.png",
   ];
 
+  // 返信の付いたスレッドの先頭は消えずに削除済みとして残る
+  const removeUndoneMessage = (messageId, { hard_delete }) => {
+    if (hard_delete) {
+      setMessages((prev) => prev.filter((msg) => msg.id !== messageId));
+    } else {
+      setMessages((prev) =>
+        prev.map((msg) => (msg.id === messageId ? { ...msg, deleted: true } : msg))
+      );
+    }
+  };
+
   const handleUndo = async (messageId) => {
     const token = localStorage.getItem("token");
     try {
@@ -204,15 +214,7 @@ function Chat({ roomId, username, onReadReaset }) {
         headers: { Authorization: `Bearer ${token}` },
       });
       if (!res.ok) throw new Error("削除失敗");
-
-      sendWhenReady({
-        type: "delete",
-        room_id: parseInt(roomId),
-        message_id: messageId,
-        text: "hard"
-      });
-
-      setMessages((prev) => prev.filter((msg) => msg.id !== messageId));
+      removeUndoneMessage(messageId, await res.json());
     } catch (err) {
       console.error("送信取り消しエラー:", err);
     }
@@ -237,15 +239,7 @@ function Chat({ roomId, username, onReadReaset }) {
           headers: { Authorization: `Bearer ${token}` },
         });
         if (!res.ok) throw new Error("送信取り消し失敗");
-
-        sendWhenReady({
-          type: "delete",
-          room_id: parseInt(roomId),
-          message_id: messageId,
-          text: "hard,"
-        });
-
-        setMessages((prev) => prev.filter((msg) => msg.id !== messageId));
+        removeUndoneMessage(messageId, await res.json());
       } else {
         // 通常の削除（論理削除）
         const res = await fetch(`http://localhost:8081/messages/${messageId}`, {
@@ -258,12 +252,6 @@ function Chat({ roomId, username, onReadReaset }) {
         });
         if (!res.ok) throw new Error("削除失敗");
 
-        sendWhenReady({
-          type: "delete",
-          room_id: parseInt(roomId),
-          message_id: messageId,
-        });
-
         setMessages((prev) =>
           prev.map((msg) =>
             msg.id === messageId ? { ...msg, deleted: true } : msg
@@ -307,43 +295,27 @@ function Chat({ roomId, username, onReadReaset }) {
       if (!roomId || !username) return;
       const token = localStorage.getItem("token");
 
-      const fetchReadStatus = async () => {
+      const fetchReadCursors = async () => {
         try {
-          const res = await fetch(`http://localhost:8081/read_status?room=${roomId}`, {
+          const res = await fetch(`http://localhost:8081/rooms/${roomId}/members`, {
             headers: {
               Authorization: `Bearer ${token}`,
             },
           });
           const data = await res.json();
           if (Array.isArray(data)) {
-            const readMap = {};
-            data.forEach((id) => {
-              readMap[id] = true;
+            const cursors = {};
+            data.forEach((m) => {
+              cursors[m.username] = m.last_read_message_id || 0;
             });
-            setReadStatus((prev) => ({ ...prev, ...readMap }));
+            setReadCursors(cursors);
           }
         } catch (err) {
           console.error("既読状態の取得失敗:", err);
         }
       };
 
-      const fetchReaders = async () => {
-        try {
-          const res = await fetch(`http://localhost:8081/read_status_full?room=${roomId}`, {
-            headers: {
-            Authorization: `Bearer ${token}` },
-          });
-          const data = await res.json();
-          if (data && typeof data === "object") {
-            setReadersByMessageId(data);
-          }
-        } catch (err) {
-          console.error("既読ユーザー一覧取得失敗:", err);
-        }
-      };
-
-    fetchReadStatus();
-    fetchReaders();
+    fetchReadCursors();
   }, [roomId, username]);
 
   useEffect(() => {
@@ -382,6 +354,19 @@ function Chat({ roomId, username, onReadReaset }) {
 }, [roomId, username]);
 
 
+  // カーソルは進むだけ（古い既読通知が後から届いても戻さない）
+  const advanceReadCursor = (name, messageId) => {
+    setReadCursors((prev) =>
+      (prev[name] || 0) >= messageId ? prev : { ...prev, [name]: messageId }
+    );
+  };
+
+  // 送信者以外で、カーソルがこのメッセージまで来ている人数
+  const countReaders = (msg) =>
+    Object.entries(readCursors).filter(
+      ([name, cursor]) => name !== msg.username && cursor >= msg.id
+    ).length;
+
   const sendWhenReady = (messageObj) => {
     const socket = socketRef.current;
     if (!socket) return;
@@ -404,9 +389,22 @@ function Chat({ roomId, username, onReadReaset }) {
       console.warn("トークンが存在しないため、WebSocket接続を中止します");
       return ;
     }
-    const ws = new WebSocket(`ws://localhost:8081/ws?token=${token}`);
+    // トークンはURLに載せず、サブプロトコルで渡す
+    const ws = new WebSocket("ws://localhost:8081/ws", ["bearer", token]);
     socketRef.current = ws;
 
+    // アクセストークンが切れる前に取り直して送り、接続を延長する
+    const reauth = setInterval(async () => {
+      try {
+        const fresh = await refreshTokens();
+        if (ws.readyState === WebSocket.OPEN) {
+          ws.send(JSON.stringify({ type: "auth", token: fresh }));
+        }
+      } catch (err) {
+        console.error("トークン更新失敗:", err);
+      }
+    }, 10 * 60 * 1000);
+
     ws.onopen = () => {
       sendWhenReady({ 
         type: "join",
@@ -416,25 +414,17 @@ function Chat({ roomId, username, onReadReaset }) {
     ws.onmessage = (event) => {
       const msg = JSON.parse(event.data);
       console.log("受信メッセージ:", msg);
+
+      // 1接続で全ルームのイベントが届くので、表示中のルーム以外は無視する
+      if (msg.room_id !== parseInt(roomId)) return;
+      if (msg.type === "mention" || msg.type === "room_joined") return;
+      // スレッド返信はタイムラインに出さない
+      if (msg.parent_message_id) return;
       msg.id = msg.id ?? msg.message_id;
 
       if (msg.type === "read"){
-        setReadStatus((prev) => ({
-          ...prev,
-          [msg.message_id]: true,
-        }));
-
-        setReadersByMessageId((prev) => {
-          const readers = prev[msg.message_id] || [];
-          if (!readers.includes(msg.username)) {
-            return {
-              ...prev,
-              [msg.message_id]: [...readers, msg.username],
-            };
-          }
-          return prev;
-        });
-
+        // message_id 以下がすべて既読になった
+        advanceReadCursor(msg.username, msg.message_id);
         return;
       }
 
@@ -452,6 +442,14 @@ function Chat({ roomId, username, onReadReaset }) {
       }
 
 
+      if (msg.type === "room_updated" && msg.room?.is_group) {
+        setRoomName(msg.room.name);
+        return;
+      }
+
+      // メンバー変更やリアクションなど、タイムラインに出さないイベント
+      if (msg.type !== "message") return;
+
       if (!msg.created_at){
         msg.created_at = new Date().toISOString();
       }
@@ -462,6 +460,7 @@ function Chat({ roomId, username, onReadReaset }) {
     };
 
     return () => {
+    clearInterval(reauth);
     if (ws.readyState === WebSocket.OPEN) {
       ws.send(JSON.stringify({
         type: "leave",
@@ -486,7 +485,7 @@ function Chat({ roomId, username, onReadReaset }) {
         });
         if (!res.ok) throw new Error("メッセージ取得に失敗");
         const data = await res.json();
-        setMessages(Array.isArray(data) ? data : []);
+        setMessages(Array.isArray(data.messages) ? data.messages : []);
       } catch (err) {
         console.error("過去メッセージ取得エラー:", err);
       }
@@ -574,17 +573,20 @@ function Chat({ roomId, username, onReadReaset }) {
         className="chat-messages" 
         style={{ overflowY: "auto", maxHeight: "60vh", padding: "0 10px" }}
       >
-        {messages?.map((msg) => (
+        {messages?.map((msg) => msg.kind === "system" ? (
+          // メンバーの追加・退出などの自動メッセージ
+          <div key={msg.id} className="system-message">{msg.text}</div>
+        ) : (
           <MessageItem
-            key={`${msg.id}-${readStatus[msg.id] ? 'read' : 'unread'}`}
+            key={msg.id}
             msg={msg}
             username={username}
             socketRef={socketRef}
             roomId={roomId}
-            readStatus={readStatus}
-            setReadStatus={setReadStatus}
+            myReadCursor={readCursors[username] || 0}
+            onRead={(id) => advanceReadCursor(username, id)}
             sendWhenReady={sendWhenReady}
-            readersByMessageId={readersByMessageId}
+            readCount={countReaders(msg)}
             scrollRefs={scrollRefs}
             onUndo={handleUndo}
             onDelete={handleDelete}
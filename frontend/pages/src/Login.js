@@ -34,8 +34,29 @@ function Login() {
 
       //レスポンスをJSONとして受け取りtokenとusrenameをseseionStageに保存
       //ページ遷移の認証で利用する
-      const responseData = await response.json(); // 🔧 変数名を重複させない
+      let responseData = await response.json(); // 🔧 変数名を重複させない
+
+      //2段階認証が有効なら、認証アプリのコード（またはリカバリーコード）を送る
+      if (responseData.two_factor_required) {
+        const code = window.prompt('認証アプリの6桁のコード、またはリカバリーコードを入力してください');
+        if (!code) return;
+        const isTotp = /^\d{6}$/.test(code.trim());
+        const res2fa = await fetch('http://localhost:8081/login/2fa', {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({
+            pre_auth_token: responseData.pre_auth_token,
+            ...(isTotp ? { code: code.trim() } : { recovery_code: code.trim() }),
+          }),
+        });
+        if (!res2fa.ok) {
+          setMessage(`ログイン失敗: ${await res2fa.text()}`);
+          return;
+        }
+        responseData = await res2fa.json();
+      }
       localStorage.setItem('token', responseData.token); // JWT保存
+      localStorage.setItem('refresh_token', responseData.refresh_token); // 期限切れ時の更新用
       localStorage.setItem('username', username);        // ユーザー名も保存
 
       
@@ -35,7 +35,12 @@ function App() {
         alert('登録成功！');
         navigate('/');
       } else {
-        const err = await response.text();
+        //入力エラーは項目ごとのメッセージが JSON で返ってくる
+        const text = await response.text();
+        let err = text;
+        try {
+          err = JSON.parse(text).errors.map((e) => e.message).join(" / ");
+        } catch (_) {}
         setMessage(`登録失敗: ${err}`);
       }
     } catch (error) {
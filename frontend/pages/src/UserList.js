@@ -5,7 +5,6 @@ function UserList({ reloadFlag}) {
   const [users, setUsers] = useState([]);
   const [groups, setGroups] = useState([]);
   const [unreadCounts, setUnreadCounts] = useState({});
-  const [privateRoomMap, setPrivateRoomMap] = useState({});
   const [privateUnreadCounts, setPrivateUnreadCounts] = useState({});
   const navigate = useNavigate();
   
@@ -30,87 +29,41 @@ function UserList({ reloadFlag}) {
     fetchUsers();
   }, [myUsername]);
 
-  // グループ一覧を取得
+  // 所属ルームの一覧（グループ・DMの未読数付き）をまとめて取得（reloadFlagトリガー）
   useEffect(() => {
-    const fetchGroups = async () => {
+    const fetchRooms = async () => {
       try {
         const token = localStorage.getItem("token");
-        const res = await fetch("http://localhost:8081/rooms?type=group", {
+        const res = await fetch("http://localhost:8081/rooms", {
           headers: { Authorization: `Bearer ${token}` },
         });
-        const data = await res.json();
-        setGroups(Array.isArray(data) ? data : []);
+        const rooms = await res.json();
+        if (!Array.isArray(rooms)) return;
+
+        const groupCounts = {};
+        const privateCounts = {};
+        rooms.forEach((room) => {
+          if (room.type === "group") {
+            groupCounts[room.room_id] = room.unread_count;
+          } else if (room.name) {
+            privateCounts[room.name] = room.unread_count;
+          }
+        });
+        setGroups(
+          rooms
+            .filter((room) => room.type === "group")
+            .map((room) => ({ room_id: room.room_id, room_name: room.name }))
+        );
+        setUnreadCounts(groupCounts);
+        setPrivateUnreadCounts(privateCounts);
       } catch (err) {
-        console.error("グループ取得失敗:", err);
+        console.error("ルーム一覧取得失敗:", err);
         setGroups([]);
       }
     };
 
-    fetchGroups();
-  }, []);
-
-  // 未読件数の再取得（reloadFlagトリガー）
-  useEffect(() => {
-    const token = localStorage.getItem("token");
-
-    const fetchUnreadCounts = async () => {
-      const results = await Promise.all(
-        groups.map(async (group) => {
-          try {
-            const res = await fetch(`http://localhost:8081/unread_count?room=${group.room_id}`, {
-              headers: { Authorization: `Bearer ${token}` },
-            });
-            const data = await res.json();
-            return { roomId: group.room_id, count: data.count };
-          } catch {
-            return { roomId: group.room_id, count: 0 };
-          }
-        })
-      );
-      const map = {};
-      results.forEach(({ roomId, count }) => {
-        map[roomId] = count;
-      });
-      setUnreadCounts(map);
-    };
-
-    const fetchPrivateUnread = async () => {
-      const roomMap = {};
-      const countMap = {};
-
-      for (const user of users) {
-        try {
-          const res = await fetch("http://localhost:8081/rooms", {
-            method: "POST",
-            headers: {
-              Authorization: `Bearer ${token}`,
-              "Content-Type": "application/json",
-            },
-            body: JSON.stringify({ members: [user.username] }),
-          });
-
-          if (!res.ok) continue;
-
-          const data = await res.json();
-          const roomId = data.room_id;
-          roomMap[user.username] = roomId;
-
-          const countRes = await fetch(`http://localhost:8081/unread_count?room=${roomId}`, {
-            headers: { Authorization: `Bearer ${token}` },
-          });
-
-          const countData = await countRes.json();
-          countMap[user.username] = countData.count;
-        } catch {}
-      }
-
-      setPrivateRoomMap(roomMap);
-      setPrivateUnreadCounts(countMap);
-    };
-
-    if (groups.length > 0) fetchUnreadCounts();
-    if (users.length > 0) fetchPrivateUnread();
-  }, [reloadFlag, groups, users]);
+    fetchRooms();
+  }, [reloadFlag]);
 
   // チャットルーム作成のハンドラ
   const handleClick = async (partnerUsername) => {
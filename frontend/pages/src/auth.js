@@ -0,0 +1,51 @@
+// アクセストークンの期限が切れたら（401）リフレッシュトークンで取り直し、1回だけ再送する
+const API = "http://localhost:8081";
+const originalFetch = window.fetch.bind(window);
+
+let refreshing = null;
+
+// 同時に複数のリクエストが401になっても、リフレッシュは1回だけにする
+export function refreshTokens() {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem("refresh_token");
+    refreshing = (refreshToken
+      ? originalFetch(`${API}/token/refresh`, {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ refresh_token: refreshToken }),
+        })
+      : Promise.reject(new Error("リフレッシュトークンがありません"))
+    )
+      .then((res) => {
+        if (!res.ok) throw new Error("トークン更新失敗");
+        return res.json();
+      })
+      .then((data) => {
+        localStorage.setItem("token", data.token);
+        localStorage.setItem("refresh_token", data.refresh_token);
+        return data.token;
+      })
+      .finally(() => {
+        refreshing = null;
+      });
+  }
+  return refreshing;
+}
+
+export function installAuthRefresh() {
+  window.fetch = async (input, init = {}) => {
+    const res = await originalFetch(input, init);
+    const auth = init.headers && init.headers.Authorization;
+    if (res.status !== 401 || !auth) return res;
+
+    try {
+      const token = await refreshTokens();
+      return originalFetch(input, {
+        ...init,
+        headers: { ...init.headers, Authorization: `Bearer ${token}` },
+      });
+    } catch (err) {
+      return res;
+    }
+  };
+}